@@ -3,11 +3,13 @@ package dht
 import (
 	"context"
 	"encoding/json"
+	"math/big"
 	"sync"
 
 	"github.com/google/uuid"
 
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 )
 
@@ -245,3 +247,51 @@ func PublishLookupEvent(ctx context.Context, ev *LookupEvent) {
 	ech := ich.(*lookupEventChannel)
 	ech.send(ctx, ev)
 }
+
+// LookupProgress is a read-only snapshot of the state of a lookup.
+type LookupProgress struct {
+	// ID is a unique identifier for the lookup instance.
+	ID uuid.UUID
+	// Key is the lookup target.
+	Key string
+	// NumHeard, NumWaiting, NumQueried and NumUnreachable are the number of peers in each state.
+	NumHeard, NumWaiting, NumQueried, NumUnreachable int
+	// ClosestQueriedDistance is the distance to the key of the closest queried peer, nil if no peer has been queried yet.
+	ClosestQueriedDistance *big.Int
+	// Peers is a copy of the state of every peer in the lookup, in ascending order by distance to the key.
+	Peers []qpeerset.QueryPeerState
+}
+
+type routingLookupProgressKey struct{}
+
+// RegisterForLookupProgress registers a lookup progress callback with the given context.
+// The returned context can be passed to DHT queries to have f called with a snapshot
+// of the lookup state after each query round.
+//
+// f is called synchronously from the lookup, so it should return quickly.
+// A single query may run several lookups in parallel, for example the WAN and LAN lookups of the dual DHT,
+// so f may be called concurrently and must be safe for concurrent use. Lookups can be told apart by LookupProgress.ID.
+func RegisterForLookupProgress(ctx context.Context, f func(*LookupProgress)) context.Context {
+	return context.WithValue(ctx, routingLookupProgressKey{}, f)
+}
+
+// publishLookupProgress calls the lookup progress callback associated with the given context, if any,
+// with a snapshot of the given lookup state.
+func publishLookupProgress(ctx context.Context, id uuid.UUID, key string, qp *qpeerset.QueryPeerset) {
+	f, ok := ctx.Value(routingLookupProgressKey{}).(func(*LookupProgress))
+	if !ok {
+		return
+	}
+
+	closest, _ := qp.ClosestQueriedDistance()
+	f(&LookupProgress{
+		ID:                     id,
+		Key:                    key,
+		NumHeard:               qp.NumHeard(),
+		NumWaiting:             qp.NumWaiting(),
+		NumQueried:             qp.NumQueried(),
+		NumUnreachable:         qp.NumUnreachable(),
+		ClosestQueriedDistance: closest,
+		Peers:                  qp.AllStates(),
+	})
+}
@@ -1,8 +1,12 @@
 package qpeerset
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	ks "github.com/whyrusleeping/go-keyspace"
@@ -20,10 +24,67 @@ const (
 	PeerQueried
 	// PeerUnreachable is applied to peers who have been queried and a response was not retrieved successfully.
 	PeerUnreachable
+	// PeerUnreachableRetryable is applied to peers who have been queried and a response was not retrieved
+	// successfully due to a transient failure, such that the peer may be queried again later in the lookup.
+	PeerUnreachableRetryable
 )
 
+// String returns the name of the peer state.
+func (s PeerState) String() string {
+	switch s {
+	case PeerHeard:
+		return "Heard"
+	case PeerWaiting:
+		return "Waiting"
+	case PeerQueried:
+		return "Queried"
+	case PeerUnreachable:
+		return "Unreachable"
+	case PeerUnreachableRetryable:
+		return "UnreachableRetryable"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// ErrKeyMismatch is returned when merging peer sets of lookups for different keys.
+var ErrKeyMismatch = errors.New("peer sets are for different keys")
+
+// ErrIllegalTransition is returned by TrySetState, and is the cause of the panic of SetState,
+// when a transition that is not allowed in strict mode is applied.
+var ErrIllegalTransition = errors.New("illegal peer state transition")
+
+// ErrPeerNotFound is returned by TrySetState when the peer is not in the peer set.
+var ErrPeerNotFound = errors.New("peer not in peer set")
+
+// allowedTransitions is the state machine that is enforced in strict mode:
+//
+//	PeerHeard -> PeerWaiting
+//	PeerWaiting -> PeerQueried | PeerUnreachable | PeerUnreachableRetryable
+//	PeerUnreachableRetryable -> PeerHeard
+var allowedTransitions = map[PeerState][]PeerState{
+	PeerHeard:                {PeerWaiting},
+	PeerWaiting:              {PeerQueried, PeerUnreachable, PeerUnreachableRetryable},
+	PeerUnreachableRetryable: {PeerHeard},
+}
+
+// IsAllowedTransition returns true if a peer may move from state from to state to in strict mode.
+// Staying in the same state is always allowed.
+func IsAllowedTransition(from, to PeerState) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range allowedTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
 // QueryPeerset maintains the state of a Kademlia asynchronous lookup.
 // The lookup state is a set of peers, each labeled with a peer state.
+// Peers are ordered by distance to the key, and peers at an equal distance by most recently added first.
 type QueryPeerset struct {
 	// the key being searched for
 	key ks.Key
@@ -31,15 +92,117 @@ type QueryPeerset struct {
 	// all known peers
 	all []queryPeerState
 
+	// index maps each known peer to its position in all
+	index map[peer.ID]int
+
+	// counts holds the number of peers, that are not excluded, in each state
+	counts map[PeerState]int
+
 	// sorted is true if all is currently in sorted order
 	sorted bool
+
+	// recordTimes is true if the time of each state transition is recorded
+	recordTimes bool
+
+	// strict is true if only allowed state transitions may be applied through SetState
+	strict bool
+
+	// maxHeard is the maximum number of peers in state PeerHeard, zero if unbounded
+	maxHeard int
+
+	// nextSeq is the insertion sequence number of the next added peer
+	nextSeq uint64
+
+	// metric computes the distances of peers to the key
+	metric DistanceMetric
+
+	// onStateChange are called, in order, on every peer state transition
+	onStateChange []StateChangeFunc
 }
 
+// DistanceMetric computes the distance of the peer p to the key of a lookup.
+type DistanceMetric interface {
+	Distance(p peer.ID, key ks.Key) *big.Int
+}
+
+// keySpaceMetric is the default DistanceMetric, which computes distances in the keyspace of the key.
+type keySpaceMetric struct{}
+
+func (keySpaceMetric) Distance(p peer.ID, key ks.Key) *big.Int {
+	return key.Space.Key([]byte(p)).Distance(key)
+}
+
+// StateChangeFunc is called when the state of peer p changes from one state to another.
+type StateChangeFunc func(p peer.ID, from, to PeerState)
+
 type queryPeerState struct {
 	id         peer.ID
 	distance   *big.Int
 	state      PeerState
 	referredBy peer.ID
+
+	// stateChangedAt is the time of the last state transition.
+	// It is only set if transition times are recorded.
+	stateChangedAt time.Time
+
+	// latency is the response latency of the peer, zero if unknown
+	latency time.Duration
+
+	// result is the result supplied by the peer, nil if none
+	result interface{}
+
+	// meta holds arbitrary metadata attached to the peer, nil until first set
+	meta map[string]interface{}
+
+	// excluded is true if the peer must never be queried
+	excluded bool
+
+	// seq is the insertion sequence number of the peer, used to break ties in distance
+	seq uint64
+}
+
+// closerThan reports whether ps comes before other in the peer set.
+// Peers are ordered by distance to the key, and peers at an equal distance by most recently added first.
+func (ps *queryPeerState) closerThan(other *queryPeerState) bool {
+	if c := ps.distance.Cmp(other.distance); c != 0 {
+		return c == -1
+	}
+	return ps.seq > other.seq
+}
+
+func copyMeta(meta map[string]interface{}) map[string]interface{} {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		c[k] = v
+	}
+	return c
+}
+
+// QueryPeerState is a read-only view of the state of a single peer in a QueryPeerset.
+type QueryPeerState struct {
+	ID peer.ID
+	// Distance is the distance of the peer to the key. It is shared with the peer set and must not be modified.
+	Distance   *big.Int
+	State      PeerState
+	ReferredBy peer.ID
+	// Latency is the response latency of the peer, zero if unknown.
+	Latency time.Duration
+	// Excluded is true if the peer must never be queried.
+	Excluded bool
+}
+
+func (ps *queryPeerState) view() QueryPeerState {
+	return QueryPeerState{
+		ID:         ps.id,
+		Distance:   ps.distance,
+		State:      ps.state,
+		ReferredBy: ps.referredBy,
+		Latency:    ps.latency,
+		Excluded:   ps.excluded,
+	}
 }
 
 type sortedQueryPeerset QueryPeerset
@@ -50,51 +213,320 @@ func (sqp *sortedQueryPeerset) Len() int {
 
 func (sqp *sortedQueryPeerset) Swap(i, j int) {
 	sqp.all[i], sqp.all[j] = sqp.all[j], sqp.all[i]
+	sqp.index[sqp.all[i].id] = i
+	sqp.index[sqp.all[j].id] = j
 }
 
 func (sqp *sortedQueryPeerset) Less(i, j int) bool {
-	di, dj := sqp.all[i].distance, sqp.all[j].distance
-	return di.Cmp(dj) == -1
+	return sqp.all[i].closerThan(&sqp.all[j])
 }
 
 // NewQueryPeerset creates a new empty set of peers.
 // key is the target key of the lookup that this peer set is for.
 func NewQueryPeerset(key string) *QueryPeerset {
+	return NewQueryPeersetWithCapacity(key, 0)
+}
+
+// NewQueryPeersetWithCapacity creates a new empty set of peers, with space preallocated for capacity peers.
+// A negative capacity is treated as zero.
+// key is the target key of the lookup that this peer set is for.
+func NewQueryPeersetWithCapacity(key string, capacity int) *QueryPeerset {
+	return newQueryPeerset(ks.XORKeySpace, keySpaceMetric{}, key, capacity)
+}
+
+// NewQueryPeersetInKeySpace creates a new empty set of peers, whose distances to the key are computed in the given keyspace
+// rather than in the XOR keyspace.
+// key is the target key of the lookup that this peer set is for, not yet converted into the keyspace.
+func NewQueryPeersetInKeySpace(key string, space ks.KeySpace) *QueryPeerset {
+	return newQueryPeerset(space, keySpaceMetric{}, key, 0)
+}
+
+// NewQueryPeersetWithMetric creates a new empty set of peers, whose distances to the key are computed by metric
+// rather than in the XOR keyspace. metric is passed the key in the XOR keyspace.
+// key is the target key of the lookup that this peer set is for.
+func NewQueryPeersetWithMetric(key string, metric DistanceMetric) *QueryPeerset {
+	return newQueryPeerset(ks.XORKeySpace, metric, key, 0)
+}
+
+func newQueryPeerset(space ks.KeySpace, metric DistanceMetric, key string, capacity int) *QueryPeerset {
+	if capacity < 0 {
+		capacity = 0
+	}
 	return &QueryPeerset{
-		key:    ks.XORKeySpace.Key([]byte(key)),
-		all:    []queryPeerState{},
-		sorted: false,
+		key:    space.Key([]byte(key)),
+		metric: metric,
+		all:    make([]queryPeerState, 0, capacity),
+		index:  make(map[peer.ID]int, capacity),
+		counts: map[PeerState]int{},
+		sorted: true, // an empty set is trivially sorted
 	}
 }
 
-func (qp *QueryPeerset) find(p peer.ID) int {
-	for i := range qp.all {
-		if qp.all[i].id == p {
-			return i
+// NewBoundedQueryPeerset creates a new empty set of peers, which holds at most maxHeard peers in state PeerHeard.
+// Once the bound is reached, adding a peer evicts the farthest peer in state PeerHeard if the added peer is closer
+// to the key, and otherwise leaves the peer set unchanged. Peers in other states are never evicted.
+// The bound is enforced by TryAdd and TryAddMany only. A non-positive maxHeard means no bound.
+// key is the target key of the lookup that this peer set is for.
+func NewBoundedQueryPeerset(key string, maxHeard int) *QueryPeerset {
+	qp := NewQueryPeerset(key)
+	if maxHeard > 0 {
+		qp.maxHeard = maxHeard
+	}
+	return qp
+}
+
+// Key returns the target key of the lookup that this peer set is for, in the keyspace of the peer set.
+// The returned key is a copy.
+func (qp *QueryPeerset) Key() ks.Key {
+	return ks.Key{
+		Space:    qp.key.Space,
+		Original: append([]byte(nil), qp.key.Original...),
+		Bytes:    append([]byte(nil), qp.key.Bytes...),
+	}
+}
+
+// Clone returns a deep copy of the peer set.
+// Mutations of the copy do not affect the original and vice versa.
+// Registered state change callbacks are not copied.
+func (qp *QueryPeerset) Clone() *QueryPeerset {
+	c := &QueryPeerset{
+		key:         qp.Key(),
+		all:         make([]queryPeerState, len(qp.all)),
+		index:       make(map[peer.ID]int, len(qp.index)),
+		counts:      make(map[PeerState]int, len(qp.counts)),
+		sorted:      qp.sorted,
+		recordTimes: qp.recordTimes,
+		strict:      qp.strict,
+		maxHeard:    qp.maxHeard,
+		nextSeq:     qp.nextSeq,
+		metric:      qp.metric,
+	}
+	for i, ps := range qp.all {
+		ps.distance = new(big.Int).Set(ps.distance)
+		ps.meta = copyMeta(ps.meta)
+		c.all[i] = ps
+	}
+	for p, i := range qp.index {
+		c.index[p] = i
+	}
+	for st, n := range qp.counts {
+		c.counts[st] = n
+	}
+	return c
+}
+
+// statePrecedence ranks peer states by how far a peer has advanced in the lookup.
+var statePrecedence = map[PeerState]int{
+	PeerHeard:                0,
+	PeerWaiting:              1,
+	PeerUnreachableRetryable: 2,
+	PeerUnreachable:          3,
+	PeerQueried:              4,
+}
+
+// Merge folds the peers of other into the peer set.
+// Both peer sets must be for the same key, otherwise ErrKeyMismatch is returned and no action is taken.
+// Distances are taken from other, so both peer sets must also use the same distance metric.
+//
+// Peers only known to other are added with the state, referrer and latency they have in other.
+// For peers known to both, the state that is furthest along in the lookup wins, according to the precedence:
+//
+//	PeerQueried > PeerUnreachable > PeerUnreachableRetryable > PeerWaiting > PeerHeard
+//
+// On equal precedence the state of the receiver is kept. The referrer of a known peer is never changed.
+// A latency or result is taken from other only if none was recorded for the peer, and
+// metadata keys are taken from other only if they are not set for the peer.
+// Peers excluded in either peer set are excluded in the merged peer set.
+// Merging is not subject to strict mode.
+func (qp *QueryPeerset) Merge(other *QueryPeerset) error {
+	if qp.key.Space != other.key.Space || !qp.key.Equal(other.key) {
+		return ErrKeyMismatch
+	}
+
+	for _, ops := range other.all {
+		i := qp.find(ops.id)
+		if i < 0 {
+			ops.distance = new(big.Int).Set(ops.distance)
+			ops.meta = copyMeta(ops.meta)
+			if qp.recordTimes && !other.recordTimes {
+				ops.stateChangedAt = time.Now()
+			}
+			qp.insert(ops)
+			continue
+		}
+
+		ps := &qp.all[i]
+		if statePrecedence[ops.state] > statePrecedence[ps.state] {
+			qp.setState(i, ops.state)
+			if qp.recordTimes && other.recordTimes {
+				ps.stateChangedAt = ops.stateChangedAt
+			}
+		}
+		if ps.latency == 0 {
+			ps.latency = ops.latency
+		}
+		if ps.result == nil {
+			ps.result = ops.result
 		}
+		for k, v := range ops.meta {
+			if _, ok := ps.meta[k]; !ok {
+				qp.setMeta(i, k, v)
+			}
+		}
+		if ops.excluded {
+			qp.exclude(i)
+		}
+	}
+	return nil
+}
+
+func (qp *QueryPeerset) find(p peer.ID) int {
+	if i, ok := qp.index[p]; ok {
+		return i
 	}
 	return -1
 }
 
 func (qp *QueryPeerset) distanceToKey(p peer.ID) *big.Int {
-	return ks.XORKeySpace.Key([]byte(p)).Distance(qp.key)
+	return qp.metric.Distance(p, qp.key)
+}
+
+// DistanceToKey returns the distance of the peer p to the key of the peer set.
+// p does not need to be in the peer set.
+func (qp *QueryPeerset) DistanceToKey(p peer.ID) *big.Int {
+	return qp.distanceToKey(p)
 }
 
 // TryAdd adds the peer p to the peer set.
 // If the peer is already present, no action is taken.
-// Otherwise, the peer is added with state set to PeerHeard.
-// TryAdd returns true iff the peer was not already present.
+// Otherwise, the peer is added with state set to PeerHeard, unless the peer set is bounded,
+// full and the peer is not closer to the key than any other peer in state PeerHeard.
+// TryAdd returns true iff the peer was added.
 func (qp *QueryPeerset) TryAdd(p, referredBy peer.ID) bool {
 	if qp.find(p) >= 0 {
 		return false
 	} else {
-		qp.all = append(qp.all,
-			queryPeerState{id: p, distance: qp.distanceToKey(p), state: PeerHeard, referredBy: referredBy})
+		return qp.add(qp.newPeerState(p, referredBy))
+	}
+}
+
+// add inserts s into the peer set. If the peer set is bounded and full, the farthest peer in state PeerHeard
+// is evicted to make room for s, or s is dropped if it is not closer to the key than that peer.
+// add returns true iff s was inserted.
+func (qp *QueryPeerset) add(s queryPeerState) bool {
+	if qp.maxHeard > 0 && qp.counts[PeerHeard] >= qp.maxHeard {
+		i := qp.farthestHeard()
+		if i < 0 || qp.all[i].distance.Cmp(s.distance) <= 0 {
+			return false
+		}
+		qp.Remove(qp.all[i].id)
+	}
+	qp.insert(s)
+	return true
+}
+
+// farthestHeard returns the position of the farthest non excluded peer in state PeerHeard, -1 if there is none.
+// It does not require the peer set to be sorted.
+func (qp *QueryPeerset) farthestHeard() int {
+	pos := -1
+	for i := range qp.all {
+		if qp.all[i].state != PeerHeard || qp.all[i].excluded {
+			continue
+		}
+		if pos < 0 || qp.all[pos].closerThan(&qp.all[i]) {
+			pos = i
+		}
+	}
+	return pos
+}
+
+// TryAddMany adds the peers to the peer set, like TryAdd.
+// Rather than inserting the peers one by one in sorted order, they are appended
+// and the peer set is sorted once when needed.
+// TryAddMany returns the number of peers that were added and, if the peer set is bounded,
+// not evicted by a closer peer of the same call.
+func (qp *QueryPeerset) TryAddMany(referredBy peer.ID, peers ...peer.ID) int {
+	var added []peer.ID
+	for _, p := range peers {
+		if qp.find(p) >= 0 {
+			continue
+		}
 		qp.sorted = false
-		return true
+		if qp.add(qp.newPeerState(p, referredBy)) {
+			added = append(added, p)
+		}
+	}
+	if qp.maxHeard == 0 {
+		return len(added)
+	}
+
+	n := 0
+	for _, p := range added {
+		if qp.find(p) >= 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (qp *QueryPeerset) newPeerState(p, referredBy peer.ID) queryPeerState {
+	s := queryPeerState{id: p, distance: qp.distanceToKey(p), state: PeerHeard, referredBy: referredBy}
+	if qp.recordTimes {
+		s.stateChangedAt = time.Now()
+	}
+	return s
+}
+
+// insert adds s to the peer set and assigns it the next insertion sequence number.
+// If the set is currently sorted, s is inserted at its position so that the set stays sorted.
+// Otherwise it is appended.
+func (qp *QueryPeerset) insert(s queryPeerState) {
+	s.seq = qp.nextSeq
+	qp.nextSeq++
+	if !s.excluded {
+		qp.counts[s.state]++
+	}
+	if !qp.sorted {
+		qp.index[s.id] = len(qp.all)
+		qp.all = append(qp.all, s)
+		return
+	}
+
+	pos := sort.Search(len(qp.all), func(i int) bool {
+		return s.closerThan(&qp.all[i])
+	})
+	qp.all = append(qp.all, queryPeerState{})
+	copy(qp.all[pos+1:], qp.all[pos:])
+	qp.all[pos] = s
+	for i := pos; i < len(qp.all); i++ {
+		qp.index[qp.all[i].id] = i
 	}
 }
 
+// Remove removes the peer p from the peer set.
+// Remove returns true iff the peer was present.
+func (qp *QueryPeerset) Remove(p peer.ID) bool {
+	pos := qp.find(p)
+	if pos < 0 {
+		return false
+	}
+
+	if !qp.all[pos].excluded {
+		qp.counts[qp.all[pos].state]--
+	}
+
+	// ordered removal, so that a sorted set stays sorted
+	copy(qp.all[pos:], qp.all[pos+1:])
+	qp.all[len(qp.all)-1] = queryPeerState{}
+	qp.all = qp.all[:len(qp.all)-1]
+
+	delete(qp.index, p)
+	for i := pos; i < len(qp.all); i++ {
+		qp.index[qp.all[i].id] = i
+	}
+	return true
+}
+
 func (qp *QueryPeerset) sort() {
 	if qp.sorted {
 		return
@@ -103,10 +535,89 @@ func (qp *QueryPeerset) sort() {
 	qp.sorted = true
 }
 
+// IsSorted returns true iff the peer set is currently sorted.
+// If it is not, the next call that returns peers in order of distance sorts it first.
+// Calls that return counts, such as NumHeard, never sort the peer set.
+func (qp *QueryPeerset) IsSorted() bool {
+	return qp.sorted
+}
+
+// StrictTransitions enables strict mode, in which SetState, TrySetState and SetStateIfPresent
+// reject transitions that are not allowed by IsAllowedTransition.
+func (qp *QueryPeerset) StrictTransitions() {
+	qp.strict = true
+}
+
 // SetState sets the state of peer p to s.
-// If p is not in the peerset, SetState panics.
+// If p is not in the peerset, or in strict mode the transition is not allowed, SetState panics.
+// SetState is meant for callers to which either case is a programming error;
+// use TrySetState to handle them as errors instead.
 func (qp *QueryPeerset) SetState(p peer.ID, s PeerState) {
-	qp.all[qp.find(p)].state = s
+	i := qp.find(p)
+	if qp.strict && !IsAllowedTransition(qp.all[i].state, s) {
+		panic(qp.illegalTransition(i, s))
+	}
+	qp.setState(i, s)
+}
+
+// TrySetState sets the state of peer p to s.
+// It returns an error wrapping ErrPeerNotFound if p is not in the peerset, or an error wrapping
+// ErrIllegalTransition if in strict mode the transition is not allowed. In both cases no action is taken.
+func (qp *QueryPeerset) TrySetState(p peer.ID, s PeerState) error {
+	i := qp.find(p)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, p)
+	}
+	if qp.strict && !IsAllowedTransition(qp.all[i].state, s) {
+		return qp.illegalTransition(i, s)
+	}
+	qp.setState(i, s)
+	return nil
+}
+
+func (qp *QueryPeerset) illegalTransition(i int, s PeerState) error {
+	return fmt.Errorf("%w: %v to %v for peer %s", ErrIllegalTransition, qp.all[i].state, s, qp.all[i].id)
+}
+
+// SetStateIfPresent sets the state of peer p to s.
+// It returns false, without taking any action, if p is not in the peerset
+// or in strict mode the transition is not allowed.
+func (qp *QueryPeerset) SetStateIfPresent(p peer.ID, s PeerState) bool {
+	i := qp.find(p)
+	if i < 0 {
+		return false
+	}
+	if qp.strict && !IsAllowedTransition(qp.all[i].state, s) {
+		return false
+	}
+	qp.setState(i, s)
+	return true
+}
+
+func (qp *QueryPeerset) setState(i int, s PeerState) {
+	ps := &qp.all[i]
+	if ps.state == s {
+		return
+	}
+	if qp.recordTimes {
+		ps.stateChangedAt = time.Now()
+	}
+	from := ps.state
+	if !ps.excluded {
+		qp.counts[from]--
+		qp.counts[s]++
+	}
+	ps.state = s
+
+	for _, f := range qp.onStateChange {
+		f(ps.id, from, s)
+	}
+}
+
+// OnStateChange registers f to be called on every peer state transition.
+// Callbacks are called in registration order and must not modify the peer set.
+func (qp *QueryPeerset) OnStateChange(f StateChangeFunc) {
+	qp.onStateChange = append(qp.onStateChange, f)
 }
 
 // GetState returns the state of peer p.
@@ -115,29 +626,423 @@ func (qp *QueryPeerset) GetState(p peer.ID) PeerState {
 	return qp.all[qp.find(p)].state
 }
 
+// GetStateOk returns the state of peer p and true.
+// If p is not in the peerset, GetStateOk returns false.
+func (qp *QueryPeerset) GetStateOk(p peer.ID) (PeerState, bool) {
+	i := qp.find(p)
+	if i < 0 {
+		return 0, false
+	}
+	return qp.all[i].state, true
+}
+
+// GetStates returns the states of the given peers.
+// present[i] is false, and states[i] is meaningless, if peers[i] is not in the peerset.
+func (qp *QueryPeerset) GetStates(peers []peer.ID) (states []PeerState, present []bool) {
+	states = make([]PeerState, len(peers))
+	present = make([]bool, len(peers))
+	for i, p := range peers {
+		states[i], present[i] = qp.GetStateOk(p)
+	}
+	return states, present
+}
+
+// RecordTransitionTimes enables recording the time of every peer state transition.
+// Peers added before the call are timestamped from the moment of the call.
+func (qp *QueryPeerset) RecordTransitionTimes() {
+	if qp.recordTimes {
+		return
+	}
+	qp.recordTimes = true
+	now := time.Now()
+	for i := range qp.all {
+		qp.all[i].stateChangedAt = now
+	}
+}
+
+// TimeInState returns for how long the peer p has been in its current state.
+// It returns zero if transition times are not recorded.
+// If p is not in the peerset, TimeInState panics.
+func (qp *QueryPeerset) TimeInState(p peer.ID) time.Duration {
+	ps := qp.all[qp.find(p)]
+	if !qp.recordTimes {
+		return 0
+	}
+	return time.Since(ps.stateChangedAt)
+}
+
+// PeersInStateOlderThan returns the peers that have been in the given state for longer than d.
+// It returns no peers if transition times are not recorded.
+// The returned peers are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) PeersInStateOlderThan(state PeerState, d time.Duration) (result []peer.ID) {
+	if !qp.recordTimes {
+		return nil
+	}
+	qp.sort()
+	now := time.Now()
+	for _, p := range qp.all {
+		if p.state == state && !p.excluded && now.Sub(p.stateChangedAt) > d {
+			result = append(result, p.id)
+		}
+	}
+	return result
+}
+
+// SetLatency records the response latency d of peer p.
+// If p is not in the peerset, SetLatency panics.
+func (qp *QueryPeerset) SetLatency(p peer.ID, d time.Duration) {
+	qp.all[qp.find(p)].latency = d
+}
+
+// GetLatency returns the recorded response latency of peer p, or zero if none was recorded.
+// If p is not in the peerset, GetLatency panics.
+func (qp *QueryPeerset) GetLatency(p peer.ID) time.Duration {
+	return qp.all[qp.find(p)].latency
+}
+
+// SetResult records the result supplied by peer p, such as a provider record or value, replacing any previous result.
+// If p is not in the peerset, SetResult panics.
+func (qp *QueryPeerset) SetResult(p peer.ID, result interface{}) {
+	qp.all[qp.find(p)].result = result
+}
+
+// GetResult returns the result supplied by peer p, or nil if none was recorded.
+// If p is not in the peerset, GetResult panics.
+func (qp *QueryPeerset) GetResult(p peer.ID) interface{} {
+	return qp.all[qp.find(p)].result
+}
+
+// GetResultProviders returns the peers that supplied a non-nil result.
+// The returned peers are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) GetResultProviders() (result []peer.ID) {
+	qp.sort()
+	for _, ps := range qp.all {
+		if ps.result != nil {
+			result = append(result, ps.id)
+		}
+	}
+	return result
+}
+
+// RetryUnreachable moves all peers that have been in state PeerUnreachableRetryable for at least backoff
+// back to state PeerHeard, so that they can be queried again.
+// If transition times are not recorded, all peers in state PeerUnreachableRetryable are moved.
+// RetryUnreachable returns the number of peers that were moved.
+func (qp *QueryPeerset) RetryUnreachable(backoff time.Duration) int {
+	now := time.Now()
+	n := 0
+	for i := range qp.all {
+		ps := &qp.all[i]
+		if ps.state != PeerUnreachableRetryable {
+			continue
+		}
+		if qp.recordTimes && now.Sub(ps.stateChangedAt) < backoff {
+			continue
+		}
+		qp.setState(i, PeerHeard)
+		n++
+	}
+	return n
+}
+
+// ResetUnreachable moves all peers in state PeerUnreachable back to state PeerHeard,
+// so that they can be queried again in a fresh lookup round. It is not subject to strict mode.
+// ResetUnreachable returns the number of peers that were moved.
+func (qp *QueryPeerset) ResetUnreachable() int {
+	n := 0
+	for i := range qp.all {
+		if qp.all[i].state == PeerUnreachable {
+			qp.setState(i, PeerHeard)
+			n++
+		}
+	}
+	return n
+}
+
+// Exclude marks the peer p as excluded, such that it is never queried.
+// Excluded peers remain in the peer set, so that their state and referrals are still known,
+// but they are neither returned by the getters that select peers by state nor counted by
+// HasPeerInState and the Num getters. Use GetExcludedInStates to retrieve them.
+// If p is not in the peerset, Exclude panics.
+func (qp *QueryPeerset) Exclude(p peer.ID) {
+	qp.exclude(qp.find(p))
+}
+
+func (qp *QueryPeerset) exclude(i int) {
+	ps := &qp.all[i]
+	if ps.excluded {
+		return
+	}
+	ps.excluded = true
+	qp.counts[ps.state]--
+}
+
+// IsExcluded returns true if the peer p has been excluded.
+// If p is not in the peerset, IsExcluded panics.
+func (qp *QueryPeerset) IsExcluded(p peer.ID) bool {
+	return qp.all[qp.find(p)].excluded
+}
+
+// GetExcludedInStates returns the excluded peers, which are in one of the given states.
+// The returned peers are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) GetExcludedInStates(states ...PeerState) (result []peer.ID) {
+	qp.sort()
+	m := makeStateSet(states)
+
+	for _, p := range qp.all {
+		if _, ok := m[p.state]; ok && p.excluded {
+			result = append(result, p.id)
+		}
+	}
+	return result
+}
+
+// SetMeta attaches the metadata val under key to peer p, replacing any previous value.
+// If p is not in the peerset, SetMeta panics.
+func (qp *QueryPeerset) SetMeta(p peer.ID, key string, val interface{}) {
+	qp.setMeta(qp.find(p), key, val)
+}
+
+func (qp *QueryPeerset) setMeta(i int, key string, val interface{}) {
+	ps := &qp.all[i]
+	if ps.meta == nil {
+		ps.meta = make(map[string]interface{})
+	}
+	ps.meta[key] = val
+}
+
+// GetMeta returns the metadata attached to peer p under key, and whether it was set.
+// If p is not in the peerset, GetMeta panics.
+func (qp *QueryPeerset) GetMeta(p peer.ID, key string) (interface{}, bool) {
+	val, ok := qp.all[qp.find(p)].meta[key]
+	return val, ok
+}
+
 // GetReferrer returns the peer that referred us to the peer p.
 // If p is not in the peerset, GetReferrer panics.
 func (qp *QueryPeerset) GetReferrer(p peer.ID) peer.ID {
 	return qp.all[qp.find(p)].referredBy
 }
 
+// ReferralDepth returns the number of referrals that led from the seeds of the lookup to the peer p,
+// by following the referrers of p for as long as they are in the peer set. Seed peers have depth zero.
+// If the chain of referrers is cyclic, ReferralDepth returns -1.
+// If p is not in the peerset, ReferralDepth panics.
+func (qp *QueryPeerset) ReferralDepth(p peer.ID) int {
+	i := qp.find(p)
+	seen := map[peer.ID]struct{}{p: {}}
+	depth := 0
+	for {
+		i = qp.find(qp.all[i].referredBy)
+		if i < 0 {
+			return depth
+		}
+		if _, ok := seen[qp.all[i].id]; ok {
+			return -1
+		}
+		seen[qp.all[i].id] = struct{}{}
+		depth++
+	}
+}
+
+// HasReferralCycle returns true if following the referrers of peer p leads into a cycle.
+// If p is not in the peerset, HasReferralCycle panics.
+func (qp *QueryPeerset) HasReferralCycle(p peer.ID) bool {
+	return qp.ReferralDepth(p) < 0
+}
+
+// DistinctReferrerCount returns the number of distinct peers that referred us to the peers in the peer set.
+func (qp *QueryPeerset) DistinctReferrerCount() int {
+	referrers := make(map[peer.ID]struct{})
+	for _, p := range qp.all {
+		referrers[p.referredBy] = struct{}{}
+	}
+	return len(referrers)
+}
+
+// DistinctGroupsInClosestN returns the number of distinct groups among the n closest queried peers,
+// such as /16 subnets or ASNs, as reported by group. Peers for which group returns "" are not counted.
+// A low number of groups relative to n suggests that the closest peers may be controlled by a single party.
+func (qp *QueryPeerset) DistinctGroupsInClosestN(n int, group func(peer.ID) string) int {
+	groups := make(map[string]struct{})
+	for _, p := range qp.GetClosestNInStates(n, PeerQueried) {
+		if g := group(p); g != "" {
+			groups[g] = struct{}{}
+		}
+	}
+	return len(groups)
+}
+
+// ReferralTree returns, for each referrer, the peers that it referred us to.
+// Referrers that are not themselves in the peer set, such as the peers that provided the seeds of the lookup, are included.
+// The referred peers are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) ReferralTree() map[peer.ID][]peer.ID {
+	qp.sort()
+	tree := make(map[peer.ID][]peer.ID)
+	for _, p := range qp.all {
+		tree[p.referredBy] = append(tree[p.referredBy], p.id)
+	}
+	return tree
+}
+
+// GetReferredBy returns the peers that the peer referrer referred us to.
+// The returned peers are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) GetReferredBy(referrer peer.ID) (result []peer.ID) {
+	qp.sort()
+	for _, p := range qp.all {
+		if p.referredBy == referrer {
+			result = append(result, p.id)
+		}
+	}
+	return result
+}
+
+// AllStates returns a copy of the state of every peer, in ascending order by distance to the key.
+// Unlike with Range, the returned distances are copies and may be modified.
+func (qp *QueryPeerset) AllStates() []QueryPeerState {
+	qp.sort()
+	result := make([]QueryPeerState, len(qp.all))
+	for i := range qp.all {
+		result[i] = qp.all[i].view()
+		result[i].Distance = new(big.Int).Set(result[i].Distance)
+	}
+	return result
+}
+
+// Range calls f for each peer in ascending order by distance to the key.
+// If f returns false, Range stops the iteration.
+// f must not modify the peer set.
+func (qp *QueryPeerset) Range(f func(QueryPeerState) bool) {
+	qp.sort()
+	for i := range qp.all {
+		if !f(qp.all[i].view()) {
+			return
+		}
+	}
+}
+
+// ClosestQueriedDistance returns the distance to the key of the closest peer in state PeerQueried.
+// It returns false if no peer has been queried yet.
+func (qp *QueryPeerset) ClosestQueriedDistance() (*big.Int, bool) {
+	qp.sort()
+	for _, p := range qp.all {
+		if p.state == PeerQueried && !p.excluded {
+			return new(big.Int).Set(p.distance), true
+		}
+	}
+	return nil, false
+}
+
 // GetClosestNInStates returns the closest to the key peers, which are in one of the given states.
-// It returns n peers or less, if fewer peers meet the condition.
+// It returns n peers or less, if fewer peers meet the condition. It returns no peers if n is not positive.
 // The returned peers are sorted in ascending order by their distance to the key.
 func (qp *QueryPeerset) GetClosestNInStates(n int, states ...PeerState) (result []peer.ID) {
-	qp.sort()
-	m := make(map[PeerState]struct{}, len(states))
-	for i := range states {
-		m[states[i]] = struct{}{}
+	if n <= 0 {
+		return nil
 	}
+	qp.sort()
+	m := makeStateSet(states)
 
 	for _, p := range qp.all {
-		if _, ok := m[p.state]; ok {
+		if _, ok := m[p.state]; ok && !p.excluded {
 			result = append(result, p.id)
+			if len(result) == n {
+				break
+			}
 		}
 	}
-	if len(result) >= n {
-		return result[:n]
+	return result
+}
+
+// GetFarthestNInStates returns the farthest from the key peers, which are in one of the given states.
+// It returns n peers or less, if fewer peers meet the condition. It returns no peers if n is not positive.
+// The returned peers are sorted in descending order by their distance to the key.
+func (qp *QueryPeerset) GetFarthestNInStates(n int, states ...PeerState) (result []peer.ID) {
+	qp.sort()
+	m := makeStateSet(states)
+
+	for i := len(qp.all) - 1; i >= 0 && len(result) < n; i-- {
+		if _, ok := m[qp.all[i].state]; ok && !qp.all[i].excluded {
+			result = append(result, qp.all[i].id)
+		}
+	}
+	return result
+}
+
+// GetFarthestInStates returns the peers, which are in one of the given states.
+// The returned peers are sorted in descending order by their distance to the key.
+func (qp *QueryPeerset) GetFarthestInStates(states ...PeerState) (result []peer.ID) {
+	return qp.GetFarthestNInStates(len(qp.all), states...)
+}
+
+// GetClosestNInStatesByLatency returns the peers with the lowest response latency, which are in one of the given states.
+// It returns n peers or less, if fewer peers meet the condition. It returns no peers if n is not positive.
+// The returned peers are sorted in ascending order by their latency. Peers without a recorded latency come last.
+// Peers with equal latency are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) GetClosestNInStatesByLatency(n int, states ...PeerState) []peer.ID {
+	if n <= 0 {
+		return nil
+	}
+	qp.sort()
+	m := makeStateSet(states)
+
+	var candidates []queryPeerState
+	for _, p := range qp.all {
+		if _, ok := m[p.state]; ok && !p.excluded {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		li, lj := candidates[i].latency, candidates[j].latency
+		if li == 0 || lj == 0 {
+			return lj == 0 && li != 0
+		}
+		return li < lj
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	var result []peer.ID
+	for _, p := range candidates {
+		result = append(result, p.id)
+	}
+	return result
+}
+
+// GetBestNInStates returns the peers with the highest score, which are in one of the given states.
+// score is called once per candidate peer, a higher score is better.
+// It returns n peers or less, if fewer peers meet the condition. It returns no peers if n is not positive.
+// The returned peers are sorted in descending order by their score.
+// Peers with equal score are sorted in ascending order by their distance to the key.
+func (qp *QueryPeerset) GetBestNInStates(n int, score func(QueryPeerState) float64, states ...PeerState) []peer.ID {
+	if n <= 0 {
+		return nil
+	}
+	qp.sort()
+	m := makeStateSet(states)
+
+	type scored struct {
+		id    peer.ID
+		score float64
+	}
+	var candidates []scored
+	for i := range qp.all {
+		p := &qp.all[i]
+		if _, ok := m[p.state]; ok && !p.excluded {
+			candidates = append(candidates, scored{id: p.id, score: score(p.view())})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	var result []peer.ID
+	for _, c := range candidates {
+		result = append(result, c.id)
 	}
 	return result
 }
@@ -148,12 +1053,78 @@ func (qp *QueryPeerset) GetClosestInStates(states ...PeerState) (result []peer.I
 	return qp.GetClosestNInStates(len(qp.all), states...)
 }
 
+// HasPeerInState returns true if any peer is in one of the given states.
+func (qp *QueryPeerset) HasPeerInState(states ...PeerState) bool {
+	for _, s := range states {
+		if qp.counts[s] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // NumHeard returns the number of peers in state PeerHeard.
 func (qp *QueryPeerset) NumHeard() int {
-	return len(qp.GetClosestInStates(PeerHeard))
+	return qp.counts[PeerHeard]
 }
 
 // NumWaiting returns the number of peers in state PeerWaiting.
 func (qp *QueryPeerset) NumWaiting() int {
-	return len(qp.GetClosestInStates(PeerWaiting))
+	return qp.counts[PeerWaiting]
+}
+
+// NumQueried returns the number of peers in state PeerQueried.
+func (qp *QueryPeerset) NumQueried() int {
+	return qp.counts[PeerQueried]
+}
+
+// NumUnreachable returns the number of peers in state PeerUnreachable.
+func (qp *QueryPeerset) NumUnreachable() int {
+	return qp.counts[PeerUnreachable]
+}
+
+// Health is a snapshot of the progress of a lookup.
+type Health struct {
+	NumHeard, NumWaiting, NumQueried, NumUnreachable int
+	// ClosestQueriedDistance is the distance to the key of the closest queried peer, nil if no peer has been queried yet.
+	ClosestQueriedDistance *big.Int
+	// DistinctReferrers is the number of distinct peers that referred us to the peers in the peer set.
+	DistinctReferrers int
+}
+
+// Health returns the peer counts, the closest queried distance and the distinct referrer count of the peer set at once.
+func (qp *QueryPeerset) Health() Health {
+	closest, _ := qp.ClosestQueriedDistance()
+	return Health{
+		NumHeard:               qp.NumHeard(),
+		NumWaiting:             qp.NumWaiting(),
+		NumQueried:             qp.NumQueried(),
+		NumUnreachable:         qp.NumUnreachable(),
+		ClosestQueriedDistance: closest,
+		DistinctReferrers:      qp.DistinctReferrerCount(),
+	}
+}
+
+func makeStateSet(states []PeerState) map[PeerState]struct{} {
+	m := make(map[PeerState]struct{}, len(states))
+	for i := range states {
+		m[states[i]] = struct{}{}
+	}
+	return m
+}
+
+// String returns a human-readable dump of the peer set, one peer per line
+// in ascending order by distance to the key.
+func (qp *QueryPeerset) String() string {
+	qp.sort()
+	var b strings.Builder
+	fmt.Fprintf(&b, "QueryPeerset(key=%x, peers=%d)", qp.key.Bytes, len(qp.all))
+	for _, ps := range qp.all {
+		fmt.Fprintf(&b, "\n  %s %s distance=%x referredBy=%s",
+			ps.id.ShortString(), ps.state, ps.distance, ps.referredBy.ShortString())
+		if ps.excluded {
+			b.WriteString(" excluded")
+		}
+	}
+	return b.String()
 }
@@ -0,0 +1,85 @@
+package qpeerset
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type queryPeersetJSON struct {
+	// Key is the original, not yet hashed, lookup key
+	Key   []byte               `json:"key"`
+	Peers []queryPeerStateJSON `json:"peers"`
+}
+
+type queryPeerStateJSON struct {
+	ID    peer.ID `json:"id"`
+	State string  `json:"state"`
+	// Distance is informational only, it is recomputed from ID and key on unmarshal
+	Distance   string        `json:"distance,omitempty"`
+	ReferredBy peer.ID       `json:"referredBy,omitempty"`
+	Latency    time.Duration `json:"latency,omitempty"`
+	Excluded   bool          `json:"excluded,omitempty"`
+}
+
+// MarshalJSON encodes the key of the peer set and, in ascending order by distance to the key,
+// the ID, state, distance, referrer, latency and exclusion of every peer.
+// Per-peer metadata and transition times are not encoded.
+func (qp *QueryPeerset) MarshalJSON() ([]byte, error) {
+	qp.sort()
+	out := queryPeersetJSON{
+		Key:   qp.key.Original,
+		Peers: make([]queryPeerStateJSON, 0, len(qp.all)),
+	}
+	for _, ps := range qp.all {
+		out.Peers = append(out.Peers, queryPeerStateJSON{
+			ID:         ps.id,
+			State:      ps.state.String(),
+			Distance:   fmt.Sprintf("%x", ps.distance),
+			ReferredBy: ps.referredBy,
+			Latency:    ps.latency,
+			Excluded:   ps.excluded,
+		})
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON replaces the peer set with the one encoded in data by MarshalJSON.
+// Distances are recomputed from the peer IDs and the key rather than read from data.
+// Options and callbacks of the peer set are reset, and distances are computed in the XOR keyspace.
+func (qp *QueryPeerset) UnmarshalJSON(data []byte) error {
+	var in queryPeersetJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	res := NewQueryPeerset(string(in.Key))
+	for _, ps := range in.Peers {
+		st, err := parsePeerState(ps.State)
+		if err != nil {
+			return err
+		}
+		if res.find(ps.ID) >= 0 {
+			return fmt.Errorf("duplicate peer %s", ps.ID)
+		}
+		s := res.newPeerState(ps.ID, ps.ReferredBy)
+		s.state = st
+		s.latency = ps.Latency
+		s.excluded = ps.Excluded
+		res.insert(s)
+	}
+
+	*qp = *res
+	return nil
+}
+
+func parsePeerState(s string) (PeerState, error) {
+	for st := PeerHeard; st <= PeerUnreachableRetryable; st++ {
+		if st.String() == s {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown peer state %q", s)
+}
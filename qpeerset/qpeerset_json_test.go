@@ -0,0 +1,84 @@
+package qpeerset
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQPeerSetJSONRoundTrip(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	qp.SetState(peers[0], PeerWaiting)
+	qp.SetState(peers[1], PeerQueried)
+	qp.SetLatency(peers[1], 42*time.Millisecond)
+	qp.SetState(peers[2], PeerUnreachableRetryable)
+
+	data, err := json.Marshal(qp)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"state":"Queried"`)
+
+	var decoded QueryPeerset
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, qp.key, decoded.key)
+	require.Equal(t, qp.AllStates(), decoded.AllStates())
+	require.Equal(t, qp.NumHeard(), decoded.NumHeard())
+	require.Equal(t, qp.NumWaiting(), decoded.NumWaiting())
+	for _, p := range peers {
+		require.Equal(t, qp.GetState(p), decoded.GetState(p))
+		require.Equal(t, qp.GetReferrer(p), decoded.GetReferrer(p))
+	}
+}
+
+func TestQPeerSetJSONRecomputesDistance(t *testing.T) {
+	p := test.RandPeerIDFatal(t)
+	data := `{"key":"dGVzdA==","peers":[{"id":"` + p.Pretty() + `","state":"Heard","distance":"0"}]}`
+
+	var qp QueryPeerset
+	require.NoError(t, json.Unmarshal([]byte(data), &qp))
+	require.Equal(t, NewQueryPeerset("test").distanceToKey(p), qp.all[0].distance)
+	require.Equal(t, peer.ID(""), qp.GetReferrer(p))
+}
+
+func TestQPeerSetJSONInvalid(t *testing.T) {
+	p := test.RandPeerIDFatal(t)
+
+	var qp QueryPeerset
+	require.Error(t, json.Unmarshal([]byte(`{"key":"dGVzdA==","peers":[{"id":"`+p.Pretty()+`","state":"Bogus"}]}`), &qp))
+	require.Error(t, json.Unmarshal([]byte(`{"key":"dGVzdA==","peers":[{"id":"`+p.Pretty()+`","state":"Heard"},{"id":"`+p.Pretty()+`","state":"Queried"}]}`), &qp))
+	require.Error(t, json.Unmarshal([]byte(`{"key":"dGVzdA==","peers":[{"id":"not a peer","state":"Heard"}]}`), &qp))
+}
+
+func TestSyncQPeerSetJSONRoundTrip(t *testing.T) {
+	sqp := NewSyncQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	require.Equal(t, 3, sqp.TryAddMany(oracle, peers...))
+	sqp.SetState(peers[0], PeerQueried)
+
+	data, err := json.Marshal(sqp)
+	require.NoError(t, err)
+	expected, err := json.Marshal(sqp.qp)
+	require.NoError(t, err)
+	require.JSONEq(t, string(expected), string(data))
+
+	var decoded SyncQueryPeerset
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, sqp.AllStates(), decoded.AllStates())
+	require.Equal(t, sqp.Key(), decoded.Key())
+}
@@ -1,12 +1,19 @@
 package qpeerset
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"math/big"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/test"
 
 	kb "github.com/libp2p/go-libp2p-kbucket"
+	ks "github.com/whyrusleeping/go-keyspace"
 
 	"github.com/stretchr/testify/require"
 )
@@ -84,3 +91,1231 @@ func TestQPeerSet(t *testing.T) {
 	require.Equal(t, []peer.ID{peer3, peer1}, qp.GetClosestInStates(PeerHeard))
 	require.Equal(t, 2, qp.NumHeard())
 }
+
+func TestQPeerSetIndexAfterSort(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+
+	peers := make([]peer.ID, 20)
+	for i := range peers {
+		peers[i] = test.RandPeerIDFatal(t)
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	qp.SetState(peers[3], PeerWaiting)
+
+	// sorting reorders all, the index must follow
+	qp.sort()
+	for _, p := range peers {
+		i := qp.find(p)
+		require.Equal(t, p, qp.all[i].id)
+	}
+	require.Equal(t, PeerWaiting, qp.GetState(peers[3]))
+}
+
+func TestQPeerSetSortedInsert(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 50; i++ {
+		p := test.RandPeerIDFatal(t)
+		peers = append(peers, p)
+		require.True(t, qp.TryAdd(p, oracle))
+
+		// adding to a sorted set keeps it sorted
+		require.True(t, qp.sorted)
+		require.Equal(t, kb.SortClosestPeers(peers, kb.ConvertKey(key)), qp.GetClosestInStates(PeerHeard))
+	}
+
+	for i := range qp.all {
+		require.Equal(t, i, qp.find(qp.all[i].id))
+	}
+}
+
+func TestQPeerSetNonPanickingAccessors(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	present := test.RandPeerIDFatal(t)
+	absent := test.RandPeerIDFatal(t)
+
+	require.True(t, qp.TryAdd(present, oracle))
+
+	st, ok := qp.GetStateOk(present)
+	require.True(t, ok)
+	require.Equal(t, PeerHeard, st)
+
+	_, ok = qp.GetStateOk(absent)
+	require.False(t, ok)
+
+	require.True(t, qp.SetStateIfPresent(present, PeerWaiting))
+	require.Equal(t, PeerWaiting, qp.GetState(present))
+
+	require.False(t, qp.SetStateIfPresent(absent, PeerWaiting))
+	require.Equal(t, -1, qp.find(absent))
+}
+
+func TestQPeerSetRemove(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		p := test.RandPeerIDFatal(t)
+		peers = append(peers, p)
+		require.True(t, qp.TryAdd(p, oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	// remove the closest, a middle and the farthest peer
+	removed := []peer.ID{sorted[0], sorted[4], sorted[9]}
+	for _, p := range removed {
+		require.True(t, qp.Remove(p))
+		require.False(t, qp.Remove(p))
+		require.Equal(t, -1, qp.find(p))
+	}
+
+	remaining := []peer.ID{sorted[1], sorted[2], sorted[3], sorted[5], sorted[6], sorted[7], sorted[8]}
+	require.Equal(t, remaining, qp.GetClosestInStates(PeerHeard))
+	for i, p := range remaining {
+		require.Equal(t, i, qp.find(p))
+	}
+
+	// a removed peer can be added again
+	require.True(t, qp.TryAdd(sorted[0], oracle))
+	require.Equal(t, sorted[0], qp.GetClosestNInStates(1, PeerHeard)[0])
+}
+
+func TestQPeerSetTimeInState(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+
+	// nothing is recorded by default
+	require.True(t, qp.TryAdd(a, oracle))
+	require.Zero(t, qp.TimeInState(a))
+	require.True(t, qp.all[qp.find(a)].stateChangedAt.IsZero())
+
+	qp.RecordTransitionTimes()
+	require.True(t, qp.TryAdd(b, oracle))
+	require.False(t, qp.all[qp.find(a)].stateChangedAt.IsZero())
+	require.False(t, qp.all[qp.find(b)].stateChangedAt.IsZero())
+
+	// pretend b entered its state a minute ago
+	qp.all[qp.find(b)].stateChangedAt = time.Now().Add(-time.Minute)
+	require.GreaterOrEqual(t, qp.TimeInState(b), time.Minute)
+
+	// setting the same state is not a transition
+	qp.SetState(b, PeerHeard)
+	require.GreaterOrEqual(t, qp.TimeInState(b), time.Minute)
+
+	// a transition resets the time in state
+	qp.SetState(b, PeerWaiting)
+	require.Less(t, qp.TimeInState(b), time.Minute)
+}
+
+func TestQPeerSetLatency(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	for _, p := range sorted {
+		qp.SetState(p, PeerQueried)
+	}
+
+	qp.SetLatency(sorted[0], 300*time.Millisecond)
+	qp.SetLatency(sorted[2], 100*time.Millisecond)
+	qp.SetLatency(sorted[3], 100*time.Millisecond)
+	require.Equal(t, 300*time.Millisecond, qp.GetLatency(sorted[0]))
+	require.Zero(t, qp.GetLatency(sorted[1]))
+
+	// equal latencies are ordered by distance, unknown latencies come last
+	require.Equal(t, []peer.ID{sorted[2], sorted[3], sorted[0], sorted[1]}, qp.GetClosestNInStatesByLatency(4, PeerQueried))
+	require.Equal(t, []peer.ID{sorted[2], sorted[3]}, qp.GetClosestNInStatesByLatency(2, PeerQueried))
+	require.Empty(t, qp.GetClosestNInStatesByLatency(2, PeerHeard))
+}
+
+func TestQPeerSetRetryUnreachable(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	qp.RecordTransitionTimes()
+	oracle := test.RandPeerIDFatal(t)
+	hard := test.RandPeerIDFatal(t)
+	soft := test.RandPeerIDFatal(t)
+	fresh := test.RandPeerIDFatal(t)
+
+	for _, p := range []peer.ID{hard, soft, fresh} {
+		require.True(t, qp.TryAdd(p, oracle))
+		qp.SetState(p, PeerWaiting)
+	}
+	qp.SetState(hard, PeerUnreachable)
+	qp.SetState(soft, PeerUnreachableRetryable)
+	qp.SetState(fresh, PeerUnreachableRetryable)
+	qp.all[qp.find(soft)].stateChangedAt = time.Now().Add(-time.Minute)
+
+	// retryable peers can be requested alongside queryable ones
+	require.ElementsMatch(t, []peer.ID{soft, fresh}, qp.GetClosestInStates(PeerHeard, PeerUnreachableRetryable))
+
+	// only the peer whose backoff has elapsed is moved back
+	require.Equal(t, 1, qp.RetryUnreachable(30*time.Second))
+	require.Equal(t, PeerHeard, qp.GetState(soft))
+	require.Equal(t, PeerUnreachableRetryable, qp.GetState(fresh))
+	require.Equal(t, PeerUnreachable, qp.GetState(hard))
+
+	require.Equal(t, 1, qp.RetryUnreachable(0))
+	require.Equal(t, PeerHeard, qp.GetState(fresh))
+	require.Equal(t, PeerUnreachable, qp.GetState(hard))
+}
+
+func TestQPeerSetClone(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(a, oracle))
+	qp.SetLatency(a, time.Second)
+
+	c := qp.Clone()
+	require.Equal(t, qp.all, c.all)
+	require.Equal(t, qp.key, c.key)
+
+	// mutating the clone leaves the original untouched
+	c.SetState(a, PeerQueried)
+	require.True(t, c.TryAdd(b, oracle))
+	c.all[c.find(a)].distance.SetInt64(0)
+	c.key.Bytes[0]++
+
+	require.Equal(t, PeerHeard, qp.GetState(a))
+	require.Equal(t, -1, qp.find(b))
+	require.Equal(t, qp.distanceToKey(a), qp.all[qp.find(a)].distance)
+	require.Equal(t, time.Second, c.GetLatency(a))
+
+	// and vice versa
+	qp.SetState(a, PeerUnreachable)
+	require.Equal(t, PeerQueried, c.GetState(a))
+}
+
+func TestQPeerSetMerge(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	other := NewQueryPeerset(key)
+	oracle1 := test.RandPeerIDFatal(t)
+	oracle2 := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	// peers[0]: Heard in qp, Queried in other -> Queried
+	// peers[1]: Queried in qp, Unreachable in other -> Queried
+	// peers[2]: Waiting in qp, Unreachable in other -> Unreachable
+	// peers[3]: only in qp
+	// peers[4]: only in other
+	for _, p := range peers[:4] {
+		require.True(t, qp.TryAdd(p, oracle1))
+	}
+	qp.SetState(peers[1], PeerQueried)
+	qp.SetState(peers[2], PeerWaiting)
+
+	for _, p := range []peer.ID{peers[0], peers[1], peers[2], peers[4]} {
+		require.True(t, other.TryAdd(p, oracle2))
+	}
+	other.SetState(peers[0], PeerQueried)
+	other.SetLatency(peers[0], time.Second)
+	other.SetState(peers[1], PeerUnreachable)
+	other.SetState(peers[2], PeerUnreachable)
+	other.SetState(peers[4], PeerWaiting)
+
+	require.NoError(t, qp.Merge(other))
+	require.Equal(t, PeerQueried, qp.GetState(peers[0]))
+	require.Equal(t, time.Second, qp.GetLatency(peers[0]))
+	require.Equal(t, oracle1, qp.GetReferrer(peers[0]))
+	require.Equal(t, PeerQueried, qp.GetState(peers[1]))
+	require.Equal(t, PeerUnreachable, qp.GetState(peers[2]))
+	require.Equal(t, PeerHeard, qp.GetState(peers[3]))
+	require.Equal(t, PeerWaiting, qp.GetState(peers[4]))
+	require.Equal(t, oracle2, qp.GetReferrer(peers[4]))
+	require.Equal(t, kb.SortClosestPeers(peers, kb.ConvertKey(key)),
+		qp.GetClosestInStates(PeerHeard, PeerWaiting, PeerQueried, PeerUnreachable))
+
+	// other is left untouched
+	require.Equal(t, -1, other.find(peers[3]))
+
+	require.ErrorIs(t, qp.Merge(NewQueryPeerset("other key")), ErrKeyMismatch)
+}
+
+func TestQPeerSetGetReferredBy(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	bad := test.RandPeerIDFatal(t)
+	good := test.RandPeerIDFatal(t)
+
+	var fromBad []peer.ID
+	for i := 0; i < 5; i++ {
+		p := test.RandPeerIDFatal(t)
+		fromBad = append(fromBad, p)
+		require.True(t, qp.TryAdd(p, bad))
+		require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), good))
+	}
+	qp.SetState(fromBad[0], PeerQueried)
+
+	require.Equal(t, kb.SortClosestPeers(fromBad, kb.ConvertKey(key)), qp.GetReferredBy(bad))
+	require.Len(t, qp.GetReferredBy(good), 5)
+	require.Empty(t, qp.GetReferredBy(test.RandPeerIDFatal(t)))
+}
+
+func TestQPeerSetGetFarthestNInStates(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 6; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	qp.SetState(sorted[5], PeerWaiting)
+
+	require.Equal(t, []peer.ID{sorted[4], sorted[3]}, qp.GetFarthestNInStates(2, PeerHeard))
+	require.Equal(t, []peer.ID{sorted[5], sorted[4]}, qp.GetFarthestNInStates(2, PeerHeard, PeerWaiting))
+	require.Equal(t, []peer.ID{sorted[4], sorted[3], sorted[2], sorted[1], sorted[0]}, qp.GetFarthestNInStates(10, PeerHeard))
+	require.Empty(t, qp.GetFarthestNInStates(2, PeerQueried))
+}
+
+func TestQPeerSetRange(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	qp.SetState(sorted[1], PeerWaiting)
+
+	var seen []peer.ID
+	qp.Range(func(ps QueryPeerState) bool {
+		seen = append(seen, ps.ID)
+		require.Equal(t, oracle, ps.ReferredBy)
+		require.Equal(t, qp.distanceToKey(ps.ID), ps.Distance)
+		return true
+	})
+	require.Equal(t, sorted, seen)
+
+	// stop at the first waiting peer
+	seen = nil
+	qp.Range(func(ps QueryPeerState) bool {
+		seen = append(seen, ps.ID)
+		return ps.State != PeerWaiting
+	})
+	require.Equal(t, sorted[:2], seen)
+}
+
+func TestQPeerSetStateCounts(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	other := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+
+	requireCounts := func(qp *QueryPeerset) {
+		t.Helper()
+		require.Equal(t, len(qp.GetClosestInStates(PeerHeard)), qp.NumHeard())
+		require.Equal(t, len(qp.GetClosestInStates(PeerWaiting)), qp.NumWaiting())
+		require.Equal(t, len(qp.GetClosestInStates(PeerQueried)), qp.NumQueried())
+		require.Equal(t, len(qp.GetClosestInStates(PeerUnreachable)), qp.NumUnreachable())
+	}
+
+	var peers []peer.ID
+	for i := 0; i < 8; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	require.Equal(t, 8, qp.NumHeard())
+	requireCounts(qp)
+
+	qp.SetState(peers[0], PeerWaiting)
+	qp.SetState(peers[1], PeerWaiting)
+	qp.SetState(peers[1], PeerWaiting)
+	qp.SetState(peers[2], PeerQueried)
+	qp.SetState(peers[3], PeerUnreachable)
+	require.True(t, qp.SetStateIfPresent(peers[4], PeerUnreachableRetryable))
+	require.Equal(t, 2, qp.NumWaiting())
+	requireCounts(qp)
+
+	require.Equal(t, 1, qp.RetryUnreachable(0))
+	requireCounts(qp)
+
+	require.True(t, qp.Remove(peers[0]))
+	require.True(t, qp.Remove(peers[5]))
+	require.Equal(t, 1, qp.NumWaiting())
+	requireCounts(qp)
+
+	require.True(t, other.TryAdd(peers[6], oracle))
+	other.SetState(peers[6], PeerQueried)
+	require.True(t, other.TryAdd(test.RandPeerIDFatal(t), oracle))
+	require.NoError(t, qp.Merge(other))
+	requireCounts(qp)
+
+	c := qp.Clone()
+	c.SetState(peers[7], PeerQueried)
+	requireCounts(c)
+	requireCounts(qp)
+}
+
+func TestQPeerSetOnStateChange(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+
+	type transition struct {
+		p        peer.ID
+		from, to PeerState
+	}
+	var first, second []transition
+	qp.OnStateChange(func(p peer.ID, from, to PeerState) {
+		first = append(first, transition{p, from, to})
+	})
+	qp.OnStateChange(func(p peer.ID, from, to PeerState) {
+		// the first callback has already been called
+		require.Len(t, first, len(second)+1)
+		second = append(second, transition{p, from, to})
+	})
+
+	require.True(t, qp.TryAdd(a, oracle))
+	require.True(t, qp.TryAdd(b, oracle))
+	require.Empty(t, first)
+
+	qp.SetState(a, PeerWaiting)
+	qp.SetState(a, PeerWaiting) // not a transition
+	qp.SetState(a, PeerUnreachableRetryable)
+	require.Equal(t, 1, qp.RetryUnreachable(0))
+	require.False(t, qp.SetStateIfPresent(test.RandPeerIDFatal(t), PeerWaiting))
+	require.True(t, qp.SetStateIfPresent(b, PeerQueried))
+
+	expected := []transition{
+		{a, PeerHeard, PeerWaiting},
+		{a, PeerWaiting, PeerUnreachableRetryable},
+		{a, PeerUnreachableRetryable, PeerHeard},
+		{b, PeerHeard, PeerQueried},
+	}
+	require.Equal(t, expected, first)
+	require.Equal(t, expected, second)
+}
+
+func TestQPeerSetTryAddMany(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	require.True(t, qp.TryAdd(peers[0], oracle))
+
+	// duplicates, within the batch and with the set, are skipped
+	require.Equal(t, 9, qp.TryAddMany(oracle, append(peers, peers[3])...))
+	require.Equal(t, 0, qp.TryAddMany(oracle, peers...))
+	require.Equal(t, 10, qp.NumHeard())
+
+	require.Equal(t, kb.SortClosestPeers(peers, kb.ConvertKey(key)), qp.GetClosestInStates(PeerHeard))
+	require.True(t, qp.sorted)
+	for i := range qp.all {
+		require.Equal(t, i, qp.find(qp.all[i].id))
+	}
+}
+
+func TestQPeerSetGetNInStatesBounds(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	for _, n := range []int{0, -1, -100} {
+		require.Empty(t, qp.GetClosestNInStates(n, PeerHeard))
+		require.Empty(t, qp.GetFarthestNInStates(n, PeerHeard))
+		require.Empty(t, qp.GetClosestNInStatesByLatency(n, PeerHeard))
+	}
+
+	require.Equal(t, sorted, qp.GetClosestNInStates(100, PeerHeard))
+	require.Equal(t, []peer.ID{sorted[2], sorted[1], sorted[0]}, qp.GetFarthestNInStates(100, PeerHeard))
+	require.Equal(t, sorted, qp.GetClosestNInStatesByLatency(100, PeerHeard))
+}
+
+func TestQPeerSetString(t *testing.T) {
+	require.Equal(t, "Waiting", PeerWaiting.String())
+	require.Equal(t, "UnreachableRetryable", PeerUnreachableRetryable.String())
+	require.Equal(t, "PeerState(42)", PeerState(42).String())
+
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(a, oracle))
+	require.True(t, qp.TryAdd(b, oracle))
+	qp.SetState(a, PeerQueried)
+
+	lines := strings.Split(qp.String(), "\n")
+	require.Len(t, lines, 3)
+	require.Contains(t, lines[0], "peers=2")
+
+	sorted := kb.SortClosestPeers([]peer.ID{a, b}, kb.ConvertKey(key))
+	for i, p := range sorted {
+		require.Contains(t, lines[i+1], p.ShortString())
+		require.Contains(t, lines[i+1], qp.GetState(p).String())
+		require.Contains(t, lines[i+1], "referredBy="+oracle.ShortString())
+	}
+}
+
+func TestQPeerSetStrictTransitions(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(a, oracle))
+	require.True(t, qp.TryAdd(b, oracle))
+
+	// lax mode allows anything
+	qp.SetState(a, PeerUnreachable)
+	qp.SetState(a, PeerWaiting)
+	qp.SetState(a, PeerHeard)
+
+	qp.StrictTransitions()
+	require.False(t, qp.SetStateIfPresent(a, PeerQueried))
+	require.Equal(t, PeerHeard, qp.GetState(a))
+	require.PanicsWithError(t, "illegal peer state transition: Heard to Queried for peer "+a.String(), func() {
+		qp.SetState(a, PeerQueried)
+	})
+
+	qp.SetState(a, PeerWaiting)
+	qp.SetState(a, PeerWaiting)
+	qp.SetState(a, PeerUnreachableRetryable)
+	qp.SetState(a, PeerHeard)
+	qp.SetState(a, PeerWaiting)
+	qp.SetState(a, PeerUnreachable)
+	require.False(t, qp.SetStateIfPresent(a, PeerWaiting))
+	require.Panics(t, func() { qp.SetState(a, PeerHeard) })
+	require.Equal(t, PeerUnreachable, qp.GetState(a))
+
+	require.True(t, qp.SetStateIfPresent(b, PeerWaiting))
+	require.True(t, qp.SetStateIfPresent(b, PeerQueried))
+	require.False(t, qp.SetStateIfPresent(b, PeerUnreachable))
+	require.Equal(t, 1, qp.NumQueried())
+	require.Equal(t, 1, qp.NumUnreachable())
+}
+
+func TestQPeerSetTrySetState(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(a, oracle))
+
+	require.ErrorIs(t, qp.TrySetState(oracle, PeerWaiting), ErrPeerNotFound)
+	require.NoError(t, qp.TrySetState(a, PeerUnreachable))
+	require.NoError(t, qp.TrySetState(a, PeerHeard))
+
+	qp.StrictTransitions()
+	err := qp.TrySetState(a, PeerQueried)
+	require.ErrorIs(t, err, ErrIllegalTransition)
+	require.EqualError(t, err, "illegal peer state transition: Heard to Queried for peer "+a.String())
+	require.Equal(t, PeerHeard, qp.GetState(a))
+
+	require.NoError(t, qp.TrySetState(a, PeerWaiting))
+	require.NoError(t, qp.TrySetState(a, PeerQueried))
+	require.Equal(t, 1, qp.NumQueried())
+	require.ErrorIs(t, qp.TrySetState(oracle, PeerWaiting), ErrPeerNotFound)
+}
+
+func TestQPeerSetMeta(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(a, oracle))
+
+	_, ok := qp.GetMeta(a, "provider")
+	require.False(t, ok)
+
+	qp.SetMeta(a, "provider", true)
+	qp.SetMeta(a, "version", "1.0")
+	qp.SetMeta(a, "version", "2.0")
+	v, ok := qp.GetMeta(a, "provider")
+	require.True(t, ok)
+	require.Equal(t, true, v)
+	v, _ = qp.GetMeta(a, "version")
+	require.Equal(t, "2.0", v)
+
+	// clones do not share metadata
+	c := qp.Clone()
+	c.SetMeta(a, "version", "3.0")
+	v, _ = qp.GetMeta(a, "version")
+	require.Equal(t, "2.0", v)
+
+	// merging only fills in missing keys
+	other := NewQueryPeerset("test")
+	require.True(t, other.TryAdd(a, oracle))
+	other.SetMeta(a, "version", "4.0")
+	other.SetMeta(a, "signed", true)
+	require.NoError(t, qp.Merge(other))
+	v, _ = qp.GetMeta(a, "version")
+	require.Equal(t, "2.0", v)
+	v, _ = qp.GetMeta(a, "signed")
+	require.Equal(t, true, v)
+}
+
+func TestQPeerSetClosestQueriedDistance(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	_, ok := qp.ClosestQueriedDistance()
+	require.False(t, ok)
+
+	qp.SetState(sorted[2], PeerQueried)
+	d, ok := qp.ClosestQueriedDistance()
+	require.True(t, ok)
+	require.Equal(t, qp.distanceToKey(sorted[2]), d)
+
+	qp.SetState(sorted[1], PeerQueried)
+	qp.SetState(sorted[0], PeerUnreachable)
+	d, ok = qp.ClosestQueriedDistance()
+	require.True(t, ok)
+	require.Equal(t, qp.distanceToKey(sorted[1]), d)
+
+	// the returned distance is a copy
+	d.SetInt64(0)
+	d, _ = qp.ClosestQueriedDistance()
+	require.Equal(t, qp.distanceToKey(sorted[1]), d)
+}
+
+func TestQPeerSetReferralDepth(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	self := test.RandPeerIDFatal(t)
+
+	var p [6]peer.ID
+	for i := range p {
+		p[i] = test.RandPeerIDFatal(t)
+	}
+
+	// self -> p0 -> p1 -> p2
+	require.True(t, qp.TryAdd(p[0], self))
+	require.True(t, qp.TryAdd(p[1], p[0]))
+	require.True(t, qp.TryAdd(p[2], p[1]))
+	require.Equal(t, 0, qp.ReferralDepth(p[0]))
+	require.Equal(t, 1, qp.ReferralDepth(p[1]))
+	require.Equal(t, 2, qp.ReferralDepth(p[2]))
+	require.False(t, qp.HasReferralCycle(p[2]))
+
+	// p3 -> p4 -> p3, p5 referred by p4
+	require.True(t, qp.TryAdd(p[3], p[4]))
+	require.True(t, qp.TryAdd(p[4], p[3]))
+	require.True(t, qp.TryAdd(p[5], p[4]))
+	require.Equal(t, -1, qp.ReferralDepth(p[3]))
+	require.True(t, qp.HasReferralCycle(p[4]))
+	require.True(t, qp.HasReferralCycle(p[5]))
+
+	// a peer referring itself
+	selfish := test.RandPeerIDFatal(t)
+	require.True(t, qp.TryAdd(selfish, selfish))
+	require.True(t, qp.HasReferralCycle(selfish))
+}
+
+func TestQPeerSetGetFarthestInStates(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	qp.SetState(sorted[3], PeerQueried)
+
+	require.Equal(t, []peer.ID{sorted[4], sorted[3], sorted[2], sorted[1], sorted[0]}, qp.GetFarthestInStates(PeerHeard, PeerQueried))
+	require.Equal(t, []peer.ID{sorted[4], sorted[2], sorted[1], sorted[0]}, qp.GetFarthestInStates(PeerHeard))
+	require.Empty(t, qp.GetFarthestInStates(PeerWaiting))
+}
+
+func TestQPeerSetHasPeerInState(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+
+	require.False(t, qp.HasPeerInState(PeerHeard))
+	require.True(t, qp.TryAdd(a, oracle))
+	require.True(t, qp.HasPeerInState(PeerHeard))
+	require.False(t, qp.HasPeerInState(PeerWaiting, PeerQueried))
+
+	qp.SetState(a, PeerWaiting)
+	require.False(t, qp.HasPeerInState(PeerHeard))
+	require.True(t, qp.HasPeerInState(PeerHeard, PeerWaiting))
+	require.False(t, qp.HasPeerInState())
+}
+
+func TestQPeerSetResetUnreachable(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	qp.StrictTransitions()
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+		qp.SetState(peers[i], PeerWaiting)
+	}
+	qp.SetState(peers[0], PeerUnreachable)
+	qp.SetState(peers[1], PeerUnreachable)
+	qp.SetState(peers[2], PeerQueried)
+
+	var reset []peer.ID
+	qp.OnStateChange(func(p peer.ID, from, to PeerState) {
+		require.Equal(t, PeerUnreachable, from)
+		require.Equal(t, PeerHeard, to)
+		reset = append(reset, p)
+	})
+
+	require.Equal(t, 2, qp.ResetUnreachable())
+	require.ElementsMatch(t, peers[:2], reset)
+	require.Equal(t, 2, qp.NumHeard())
+	require.Equal(t, 0, qp.NumUnreachable())
+	require.Equal(t, PeerQueried, qp.GetState(peers[2]))
+	require.Equal(t, PeerWaiting, qp.GetState(peers[3]))
+
+	require.Equal(t, 0, qp.ResetUnreachable())
+}
+
+func TestQPeerSetWithCapacity(t *testing.T) {
+	qp := NewQueryPeersetWithCapacity("test", 64)
+	require.Equal(t, 64, cap(qp.all))
+	require.Equal(t, NewQueryPeerset("test").key, qp.key)
+
+	oracle := test.RandPeerIDFatal(t)
+	for i := 0; i < 64; i++ {
+		require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), oracle))
+	}
+	require.Equal(t, 64, cap(qp.all))
+	require.Equal(t, 64, qp.NumHeard())
+
+	qp = NewQueryPeersetWithCapacity("test", -1)
+	require.Equal(t, 0, cap(qp.all))
+	require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), oracle))
+}
+
+func TestQPeerSetPeersInStateOlderThan(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	stuck := test.RandPeerIDFatal(t)
+	recent := test.RandPeerIDFatal(t)
+	heard := test.RandPeerIDFatal(t)
+
+	require.True(t, qp.TryAdd(stuck, oracle))
+	qp.SetState(stuck, PeerWaiting)
+	require.Empty(t, qp.PeersInStateOlderThan(PeerWaiting, 0))
+
+	qp.RecordTransitionTimes()
+	require.True(t, qp.TryAdd(recent, oracle))
+	require.True(t, qp.TryAdd(heard, oracle))
+	qp.SetState(recent, PeerWaiting)
+	qp.all[qp.find(stuck)].stateChangedAt = time.Now().Add(-time.Minute)
+	qp.all[qp.find(heard)].stateChangedAt = time.Now().Add(-time.Minute)
+
+	require.Equal(t, []peer.ID{stuck}, qp.PeersInStateOlderThan(PeerWaiting, 10*time.Second))
+	require.Equal(t, []peer.ID{heard}, qp.PeersInStateOlderThan(PeerHeard, 10*time.Second))
+	require.Empty(t, qp.PeersInStateOlderThan(PeerWaiting, time.Hour))
+}
+
+func TestQPeerSetGetStates(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	absent := test.RandPeerIDFatal(t)
+
+	require.True(t, qp.TryAdd(a, oracle))
+	require.True(t, qp.TryAdd(b, oracle))
+	qp.SetState(b, PeerWaiting)
+
+	states, present := qp.GetStates([]peer.ID{b, absent, a})
+	require.Equal(t, []bool{true, false, true}, present)
+	require.Equal(t, PeerWaiting, states[0])
+	require.Equal(t, PeerHeard, states[2])
+
+	states, present = qp.GetStates(nil)
+	require.Empty(t, states)
+	require.Empty(t, present)
+}
+
+func TestQPeerSetExclude(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	qp.Exclude(sorted[0])
+	qp.Exclude(sorted[0])
+	require.True(t, qp.IsExcluded(sorted[0]))
+	require.False(t, qp.IsExcluded(sorted[1]))
+
+	require.Equal(t, sorted[1:], qp.GetClosestInStates(PeerHeard))
+	require.Equal(t, []peer.ID{sorted[1]}, qp.GetClosestNInStates(1, PeerHeard))
+	require.Equal(t, []peer.ID{sorted[3], sorted[2], sorted[1]}, qp.GetFarthestInStates(PeerHeard))
+	require.Equal(t, sorted[1:], qp.GetClosestNInStatesByLatency(4, PeerHeard))
+	require.Equal(t, []peer.ID{sorted[0]}, qp.GetExcludedInStates(PeerHeard))
+	require.Equal(t, 3, qp.NumHeard())
+
+	// excluded peers still transition, but are not counted
+	qp.SetState(sorted[0], PeerWaiting)
+	require.Equal(t, 3, qp.NumHeard())
+	require.Equal(t, 0, qp.NumWaiting())
+	require.False(t, qp.HasPeerInState(PeerWaiting))
+	require.Equal(t, []peer.ID{sorted[0]}, qp.GetExcludedInStates(PeerWaiting))
+
+	// the referral graph stays intact
+	require.Equal(t, oracle, qp.GetReferrer(sorted[0]))
+
+	// exclusion is carried over by Clone and Merge
+	c := qp.Clone()
+	require.True(t, c.IsExcluded(sorted[0]))
+	other := NewQueryPeerset(key)
+	require.True(t, other.TryAdd(sorted[1], oracle))
+	other.Exclude(sorted[1])
+	require.NoError(t, qp.Merge(other))
+	require.True(t, qp.IsExcluded(sorted[1]))
+	require.Equal(t, 2, qp.NumHeard())
+
+	require.True(t, qp.Remove(sorted[0]))
+	require.Equal(t, 0, qp.NumWaiting())
+
+	// excluded queried peers do not drive the lookup
+	qp = NewQueryPeerset(key)
+	qp.RecordTransitionTimes()
+	require.True(t, qp.TryAdd(sorted[0], oracle))
+	qp.SetState(sorted[0], PeerQueried)
+	qp.Exclude(sorted[0])
+	_, ok := qp.ClosestQueriedDistance()
+	require.False(t, ok)
+	require.Nil(t, qp.PeersInStateOlderThan(PeerQueried, 0))
+	require.Equal(t, Health{DistinctReferrers: 1}, qp.Health())
+}
+
+func TestQPeerSetKey(t *testing.T) {
+	qp := NewQueryPeerset("test")
+
+	k := qp.Key()
+	require.Equal(t, []byte("test"), k.Original)
+	require.True(t, ks.XORKeySpace.Key([]byte("test")).Equal(k))
+
+	// the returned key is a copy
+	k.Bytes[0]++
+	require.True(t, ks.XORKeySpace.Key([]byte("test")).Equal(qp.Key()))
+}
+
+func TestQPeerSetGetBestNInStates(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	qp.SetState(sorted[4], PeerQueried)
+
+	// prefer responsive peers, break ties by distance
+	qp.SetMeta(sorted[3], "responsive", true)
+	qp.SetMeta(sorted[2], "responsive", true)
+	score := func(ps QueryPeerState) float64 {
+		if v, _ := qp.GetMeta(ps.ID, "responsive"); v == true {
+			return 1
+		}
+		return 0
+	}
+
+	require.Equal(t, []peer.ID{sorted[2], sorted[3], sorted[0]}, qp.GetBestNInStates(3, score, PeerHeard))
+	require.Equal(t, []peer.ID{sorted[2], sorted[3], sorted[0], sorted[1]}, qp.GetBestNInStates(10, score, PeerHeard))
+	require.Empty(t, qp.GetBestNInStates(0, score, PeerHeard))
+
+	// a distance-only score reproduces the closest getter
+	byDistance := func(ps QueryPeerState) float64 {
+		f, _ := new(big.Float).SetInt(ps.Distance).Float64()
+		return -f
+	}
+	require.Equal(t, qp.GetClosestNInStates(3, PeerHeard, PeerQueried), qp.GetBestNInStates(3, byDistance, PeerHeard, PeerQueried))
+}
+
+func TestQPeerSetDistinctReferrerCount(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	require.Equal(t, 0, qp.DistinctReferrerCount())
+
+	r1 := test.RandPeerIDFatal(t)
+	r2 := test.RandPeerIDFatal(t)
+	for i := 0; i < 5; i++ {
+		require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), r1))
+	}
+	require.Equal(t, 1, qp.DistinctReferrerCount())
+
+	require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), r2))
+	require.Equal(t, 2, qp.DistinctReferrerCount())
+}
+
+func TestQPeerSetAllStates(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	qp.SetState(sorted[1], PeerQueried)
+
+	states := qp.AllStates()
+	require.Len(t, states, 3)
+	for i, ps := range states {
+		require.Equal(t, sorted[i], ps.ID)
+		require.Equal(t, qp.GetState(ps.ID), ps.State)
+		require.Equal(t, oracle, ps.ReferredBy)
+	}
+
+	// the returned states are copies
+	states[0].Distance.SetInt64(0)
+	states[0].State = PeerUnreachable
+	require.Equal(t, qp.distanceToKey(sorted[0]), qp.all[0].distance)
+	require.Equal(t, PeerHeard, qp.GetState(sorted[0]))
+}
+
+func TestQPeerSetDistanceToKey(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+
+	require.Equal(t, ks.XORKeySpace.Key([]byte(a)).Distance(ks.XORKeySpace.Key([]byte(key))), qp.DistanceToKey(a))
+	require.True(t, qp.TryAdd(b, a))
+	require.Equal(t, qp.all[0].distance, qp.DistanceToKey(b))
+}
+
+func TestQPeerSetBounded(t *testing.T) {
+	key := "test"
+	qp := NewBoundedQueryPeerset(key, 2)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	// the farthest peer is not evicted once it is being queried
+	require.True(t, qp.TryAdd(sorted[4], oracle))
+	qp.SetState(sorted[4], PeerWaiting)
+
+	require.True(t, qp.TryAdd(sorted[2], oracle))
+	require.True(t, qp.TryAdd(sorted[3], oracle))
+	require.Equal(t, 2, qp.NumHeard())
+
+	// a closer peer evicts the farthest heard peer, which then does not make the cut anymore
+	require.True(t, qp.TryAdd(sorted[1], oracle))
+	require.Equal(t, []peer.ID{sorted[1], sorted[2]}, qp.GetClosestInStates(PeerHeard))
+	require.False(t, qp.TryAdd(sorted[3], oracle))
+	require.Equal(t, []peer.ID{sorted[1], sorted[2]}, qp.GetClosestInStates(PeerHeard))
+
+	require.Equal(t, 1, qp.TryAddMany(oracle, sorted[0], sorted[3]))
+	require.Equal(t, []peer.ID{sorted[0], sorted[1]}, qp.GetClosestInStates(PeerHeard))
+	require.Equal(t, []peer.ID{sorted[4]}, qp.GetClosestInStates(PeerWaiting))
+	require.Len(t, qp.all, 3)
+	for i, ps := range qp.all {
+		require.Equal(t, i, qp.index[ps.id])
+	}
+
+	// the bound is kept by clones
+	c := qp.Clone()
+	require.False(t, c.TryAdd(sorted[2], oracle))
+
+	// peers of a batch larger than the bound that are evicted by the same batch are not counted
+	qp = NewBoundedQueryPeerset(key, 2)
+	require.Equal(t, 2, qp.TryAddMany(oracle, sorted[4], sorted[3], sorted[2], sorted[1]))
+	require.Equal(t, []peer.ID{sorted[1], sorted[2]}, qp.GetClosestInStates(PeerHeard))
+	require.Equal(t, 1, qp.TryAddMany(oracle, sorted[3], sorted[0], sorted[4]))
+	require.Equal(t, []peer.ID{sorted[0], sorted[1]}, qp.GetClosestInStates(PeerHeard))
+
+	// without a bound, all peers are kept
+	qp = NewBoundedQueryPeerset(key, 0)
+	require.Equal(t, 5, qp.TryAddMany(oracle, peers...))
+}
+
+func TestQPeerSetResults(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	require.Nil(t, qp.GetResultProviders())
+	require.Nil(t, qp.GetResult(sorted[0]))
+
+	qp.SetResult(sorted[3], "value")
+	qp.SetResult(sorted[1], []byte("record"))
+	qp.SetResult(sorted[2], nil)
+	require.Equal(t, "value", qp.GetResult(sorted[3]))
+	require.Equal(t, []peer.ID{sorted[1], sorted[3]}, qp.GetResultProviders())
+
+	// results are only taken from the other peer set if none was recorded
+	other := qp.Clone()
+	other.SetResult(sorted[0], "other")
+	other.SetResult(sorted[3], "other")
+	require.NoError(t, qp.Merge(other))
+	require.Equal(t, "other", qp.GetResult(sorted[0]))
+	require.Equal(t, "value", qp.GetResult(sorted[3]))
+}
+
+func TestQPeerSetDistinctGroupsInClosestN(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	groups := map[peer.ID]string{
+		sorted[0]: "10.0.0.0/16",
+		sorted[1]: "10.0.0.0/16",
+		sorted[2]: "",
+		sorted[3]: "192.168.0.0/16",
+		sorted[4]: "172.16.0.0/16",
+	}
+	group := func(p peer.ID) string { return groups[p] }
+
+	require.Equal(t, 0, qp.DistinctGroupsInClosestN(5, group))
+
+	for _, p := range sorted[1:] {
+		qp.SetState(p, PeerQueried)
+	}
+	require.Equal(t, 1, qp.DistinctGroupsInClosestN(2, group))
+	require.Equal(t, 2, qp.DistinctGroupsInClosestN(3, group))
+	require.Equal(t, 3, qp.DistinctGroupsInClosestN(5, group))
+}
+
+// sha512KeySpace is an XOR keyspace with SHA-512 as its hash function.
+type sha512KeySpace struct{}
+
+func (s sha512KeySpace) Key(id []byte) ks.Key {
+	h := sha512.Sum512(id)
+	return ks.Key{Space: s, Original: id, Bytes: h[:]}
+}
+
+func (sha512KeySpace) Equal(k1, k2 ks.Key) bool {
+	return bytes.Equal(k1.Bytes, k2.Bytes)
+}
+
+func (sha512KeySpace) Distance(k1, k2 ks.Key) *big.Int {
+	d := make([]byte, len(k1.Bytes))
+	for i := range d {
+		d[i] = k1.Bytes[i] ^ k2.Bytes[i]
+	}
+	return new(big.Int).SetBytes(d)
+}
+
+func (sha512KeySpace) Less(k1, k2 ks.Key) bool {
+	return bytes.Compare(k1.Bytes, k2.Bytes) < 0
+}
+
+func TestQPeerSetInKeySpace(t *testing.T) {
+	key := "test"
+	space := sha512KeySpace{}
+	qp := NewQueryPeersetInKeySpace(key, space)
+	require.Equal(t, space.Key([]byte(key)), qp.Key())
+
+	oracle := test.RandPeerIDFatal(t)
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	require.Equal(t, 10, qp.TryAddMany(oracle, peers...))
+
+	distance := func(p peer.ID) *big.Int {
+		return space.Key([]byte(p)).Distance(space.Key([]byte(key)))
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return distance(peers[i]).Cmp(distance(peers[j])) < 0
+	})
+	require.Equal(t, peers, qp.GetClosestInStates(PeerHeard))
+	for _, p := range peers {
+		require.Equal(t, distance(p), qp.DistanceToKey(p))
+	}
+
+	require.ErrorIs(t, qp.Merge(NewQueryPeerset(key)), ErrKeyMismatch)
+	require.NoError(t, qp.Merge(qp.Clone()))
+}
+
+func TestQPeerSetHealth(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	require.Equal(t, Health{}, qp.Health())
+
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	require.Equal(t, 3, qp.TryAddMany(a, peers[:3]...))
+	require.Equal(t, 2, qp.TryAddMany(b, peers[3:]...))
+	qp.SetState(peers[0], PeerWaiting)
+	qp.SetState(peers[1], PeerQueried)
+	qp.SetState(peers[2], PeerQueried)
+	qp.SetState(peers[3], PeerUnreachable)
+
+	closest, ok := qp.ClosestQueriedDistance()
+	require.True(t, ok)
+	require.Equal(t, Health{
+		NumHeard:               1,
+		NumWaiting:             1,
+		NumQueried:             2,
+		NumUnreachable:         1,
+		ClosestQueriedDistance: closest,
+		DistinctReferrers:      2,
+	}, qp.Health())
+}
+
+func TestQPeerSetTieBreakByInsertion(t *testing.T) {
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	qp := NewQueryPeersetFromStates("test", []QueryPeerState{
+		{ID: peers[0], Distance: big.NewInt(1)},
+		{ID: peers[1], Distance: big.NewInt(0)},
+		{ID: peers[2], Distance: big.NewInt(1)},
+	})
+	require.Equal(t, []peer.ID{peers[1], peers[2], peers[0]}, qp.GetClosestInStates(PeerHeard))
+
+	// the most recently added peer comes first, whether inserted in order or sorted later
+	s := qp.newPeerState(peers[3], "")
+	s.distance = big.NewInt(1)
+	qp.insert(s)
+	require.Equal(t, []peer.ID{peers[1], peers[3], peers[2], peers[0]}, qp.GetClosestInStates(PeerHeard))
+
+	qp.sorted = false
+	qp.all[0], qp.all[3] = qp.all[3], qp.all[0]
+	qp.all[1], qp.all[2] = qp.all[2], qp.all[1]
+	for i, ps := range qp.all {
+		qp.index[ps.id] = i
+	}
+	require.Equal(t, []peer.ID{peers[1], peers[3], peers[2], peers[0]}, qp.GetClosestInStates(PeerHeard))
+	require.Equal(t, []peer.ID{peers[0], peers[2]}, qp.GetFarthestNInStates(2, PeerHeard))
+}
+
+func TestQPeerSetIsSorted(t *testing.T) {
+	qp := NewQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+	require.True(t, qp.IsSorted())
+
+	require.True(t, qp.TryAdd(test.RandPeerIDFatal(t), oracle))
+	require.True(t, qp.IsSorted())
+
+	require.Equal(t, 2, qp.TryAddMany(oracle, test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)))
+	require.False(t, qp.IsSorted())
+	require.Equal(t, 3, qp.NumHeard())
+	require.False(t, qp.IsSorted())
+
+	qp.GetClosestNInStates(1, PeerHeard)
+	require.True(t, qp.IsSorted())
+}
+
+func TestQPeerSetReferralTree(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeerset(key)
+	require.Empty(t, qp.ReferralTree())
+
+	self := test.RandPeerIDFatal(t)
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	require.Equal(t, 2, qp.TryAddMany(self, peers[0], peers[1]))
+	require.Equal(t, 2, qp.TryAddMany(peers[0], peers[2], peers[3]))
+	require.True(t, qp.TryAdd(peers[4], peers[3]))
+
+	require.Equal(t, map[peer.ID][]peer.ID{
+		self:     kb.SortClosestPeers(peers[:2], kb.ConvertKey(key)),
+		peers[0]: kb.SortClosestPeers(peers[2:4], kb.ConvertKey(key)),
+		peers[3]: {peers[4]},
+	}, qp.ReferralTree())
+}
+
+// reverseXORMetric orders peers from the farthest to the closest by XOR distance.
+type reverseXORMetric struct{}
+
+func (reverseXORMetric) Distance(p peer.ID, key ks.Key) *big.Int {
+	max := new(big.Int).Lsh(big.NewInt(1), 256)
+	return max.Sub(max, ks.XORKeySpace.Key([]byte(p)).Distance(key))
+}
+
+func TestQPeerSetWithMetric(t *testing.T) {
+	key := "test"
+	qp := NewQueryPeersetWithMetric(key, reverseXORMetric{})
+	oracle := test.RandPeerIDFatal(t)
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+		require.True(t, qp.TryAdd(peers[i], oracle))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	require.Equal(t, sorted, qp.GetFarthestInStates(PeerHeard))
+	require.Equal(t, []peer.ID{sorted[4], sorted[3]}, qp.GetClosestNInStates(2, PeerHeard))
+	require.Equal(t, reverseXORMetric{}.Distance(peers[0], ks.XORKeySpace.Key([]byte(key))), qp.DistanceToKey(peers[0]))
+
+	c := qp.Clone()
+	p := test.RandPeerIDFatal(t)
+	require.True(t, c.TryAdd(p, oracle))
+	require.Equal(t, qp.DistanceToKey(p), c.DistanceToKey(p))
+}
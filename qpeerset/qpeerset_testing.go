@@ -0,0 +1,33 @@
+package qpeerset
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// NewQueryPeersetFromStates creates a peer set for the given key holding exactly the given peers,
+// in the given states, with the given referrers, latencies and exclusions.
+//
+// This is intended for tests and other advanced uses that need a peer set in a known configuration.
+// A non-nil Distance is used as is instead of the distance of the peer ID to the key, which makes
+// it possible to control the order of the peers without searching for IDs that hash to specific
+// distances. The distance of peers added afterwards is computed as usual.
+//
+// NewQueryPeersetFromStates panics if a peer appears more than once.
+func NewQueryPeersetFromStates(key string, states []QueryPeerState) *QueryPeerset {
+	qp := NewQueryPeersetWithCapacity(key, len(states))
+	for _, st := range states {
+		if qp.find(st.ID) >= 0 {
+			panic(fmt.Sprintf("duplicate peer %s", st.ID))
+		}
+		s := qp.newPeerState(st.ID, st.ReferredBy)
+		if st.Distance != nil {
+			s.distance = new(big.Int).Set(st.Distance)
+		}
+		s.state = st.State
+		s.latency = st.Latency
+		s.excluded = st.Excluded
+		qp.insert(s)
+	}
+	return qp
+}
@@ -0,0 +1,44 @@
+package qpeerset
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQPeerSetFromStates(t *testing.T) {
+	oracle := test.RandPeerIDFatal(t)
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	qp := NewQueryPeersetFromStates("test", []QueryPeerState{
+		{ID: peers[0], Distance: big.NewInt(3), State: PeerQueried, ReferredBy: oracle},
+		{ID: peers[1], Distance: big.NewInt(1), State: PeerHeard},
+		{ID: peers[2], Distance: big.NewInt(2), State: PeerHeard, Excluded: true},
+		{ID: peers[3], Distance: big.NewInt(0), State: PeerUnreachable},
+	})
+
+	require.Equal(t, []peer.ID{peers[3], peers[1], peers[0]}, qp.GetClosestInStates(PeerHeard, PeerQueried, PeerUnreachable))
+	require.Equal(t, []peer.ID{peers[1]}, qp.GetClosestNInStates(2, PeerHeard))
+	require.Equal(t, oracle, qp.GetReferrer(peers[0]))
+	require.True(t, qp.IsExcluded(peers[2]))
+	require.Equal(t, 1, qp.NumHeard())
+	require.Equal(t, 1, qp.NumQueried())
+	require.Equal(t, 1, qp.NumUnreachable())
+
+	// peers without an injected distance use their real distance
+	p := test.RandPeerIDFatal(t)
+	qp = NewQueryPeersetFromStates("test", []QueryPeerState{{ID: p, State: PeerWaiting}})
+	require.Equal(t, qp.distanceToKey(p), qp.all[0].distance)
+	require.Equal(t, 1, qp.NumWaiting())
+
+	require.Panics(t, func() {
+		NewQueryPeersetFromStates("test", []QueryPeerState{{ID: p}, {ID: p}})
+	})
+}
@@ -0,0 +1,469 @@
+package qpeerset
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ks "github.com/whyrusleeping/go-keyspace"
+)
+
+// SyncQueryPeerset is a QueryPeerset that is safe for concurrent use.
+// Mutations take an exclusive lock, reads take a shared lock.
+type SyncQueryPeerset struct {
+	lk sync.RWMutex
+	qp *QueryPeerset
+}
+
+// NewSyncQueryPeerset creates a new empty set of peers that is safe for concurrent use.
+// key is the target key of the lookup that this peer set is for.
+func NewSyncQueryPeerset(key string) *SyncQueryPeerset {
+	return &SyncQueryPeerset{qp: NewQueryPeerset(key)}
+}
+
+// NewSyncQueryPeersetWithCapacity creates a new empty set of peers that is safe for concurrent use,
+// with space preallocated for capacity peers. A negative capacity is treated as zero.
+// key is the target key of the lookup that this peer set is for.
+func NewSyncQueryPeersetWithCapacity(key string, capacity int) *SyncQueryPeerset {
+	return &SyncQueryPeerset{qp: NewQueryPeersetWithCapacity(key, capacity)}
+}
+
+// NewSyncQueryPeersetInKeySpace creates a new empty set of peers that is safe for concurrent use,
+// whose distances to the key are computed in the given keyspace. See NewQueryPeersetInKeySpace.
+func NewSyncQueryPeersetInKeySpace(key string, space ks.KeySpace) *SyncQueryPeerset {
+	return &SyncQueryPeerset{qp: NewQueryPeersetInKeySpace(key, space)}
+}
+
+// NewSyncQueryPeersetWithMetric creates a new empty set of peers that is safe for concurrent use,
+// whose distances to the key are computed by metric. See NewQueryPeersetWithMetric.
+func NewSyncQueryPeersetWithMetric(key string, metric DistanceMetric) *SyncQueryPeerset {
+	return &SyncQueryPeerset{qp: NewQueryPeersetWithMetric(key, metric)}
+}
+
+// NewBoundedSyncQueryPeerset creates a new empty set of peers that is safe for concurrent use,
+// which holds at most maxHeard peers in state PeerHeard. See NewBoundedQueryPeerset.
+// key is the target key of the lookup that this peer set is for.
+func NewBoundedSyncQueryPeerset(key string, maxHeard int) *SyncQueryPeerset {
+	return &SyncQueryPeerset{qp: NewBoundedQueryPeerset(key, maxHeard)}
+}
+
+// Key is the concurrency safe version of QueryPeerset.Key.
+func (sqp *SyncQueryPeerset) Key() ks.Key {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.Key()
+}
+
+// Clone is the concurrency safe version of QueryPeerset.Clone.
+func (sqp *SyncQueryPeerset) Clone() *SyncQueryPeerset {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return &SyncQueryPeerset{qp: sqp.qp.Clone()}
+}
+
+// Merge is the concurrency safe version of QueryPeerset.Merge.
+func (sqp *SyncQueryPeerset) Merge(other *SyncQueryPeerset) error {
+	// copy other first rather than holding both locks, which could deadlock
+	oqp := other.Clone().qp
+
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.Merge(oqp)
+}
+
+// rlockSorted acquires the read lock on a sorted peer set.
+// Getters sort the peer set on demand, which must not happen under the read lock.
+func (sqp *SyncQueryPeerset) rlockSorted() {
+	for {
+		sqp.lk.RLock()
+		if sqp.qp.sorted {
+			return
+		}
+		sqp.lk.RUnlock()
+
+		sqp.lk.Lock()
+		sqp.qp.sort()
+		sqp.lk.Unlock()
+	}
+}
+
+// TryAdd is the concurrency safe version of QueryPeerset.TryAdd.
+func (sqp *SyncQueryPeerset) TryAdd(p, referredBy peer.ID) bool {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.TryAdd(p, referredBy)
+}
+
+// TryAddMany is the concurrency safe version of QueryPeerset.TryAddMany.
+func (sqp *SyncQueryPeerset) TryAddMany(referredBy peer.ID, peers ...peer.ID) int {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.TryAddMany(referredBy, peers...)
+}
+
+// Remove is the concurrency safe version of QueryPeerset.Remove.
+func (sqp *SyncQueryPeerset) Remove(p peer.ID) bool {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.Remove(p)
+}
+
+// IsSorted is the concurrency safe version of QueryPeerset.IsSorted.
+func (sqp *SyncQueryPeerset) IsSorted() bool {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.IsSorted()
+}
+
+// StrictTransitions is the concurrency safe version of QueryPeerset.StrictTransitions.
+func (sqp *SyncQueryPeerset) StrictTransitions() {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.StrictTransitions()
+}
+
+// SetState is the concurrency safe version of QueryPeerset.SetState.
+func (sqp *SyncQueryPeerset) SetState(p peer.ID, s PeerState) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.SetState(p, s)
+}
+
+// GetState is the concurrency safe version of QueryPeerset.GetState.
+func (sqp *SyncQueryPeerset) GetState(p peer.ID) PeerState {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetState(p)
+}
+
+// TrySetState is the concurrency safe version of QueryPeerset.TrySetState.
+func (sqp *SyncQueryPeerset) TrySetState(p peer.ID, s PeerState) error {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.TrySetState(p, s)
+}
+
+// SetStateIfPresent is the concurrency safe version of QueryPeerset.SetStateIfPresent.
+func (sqp *SyncQueryPeerset) SetStateIfPresent(p peer.ID, s PeerState) bool {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.SetStateIfPresent(p, s)
+}
+
+// GetStateOk is the concurrency safe version of QueryPeerset.GetStateOk.
+func (sqp *SyncQueryPeerset) GetStateOk(p peer.ID) (PeerState, bool) {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetStateOk(p)
+}
+
+// OnStateChange is the concurrency safe version of QueryPeerset.OnStateChange.
+// f is called with the lock held, so it must not call methods of sqp.
+func (sqp *SyncQueryPeerset) OnStateChange(f StateChangeFunc) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.OnStateChange(f)
+}
+
+// GetStates is the concurrency safe version of QueryPeerset.GetStates.
+func (sqp *SyncQueryPeerset) GetStates(peers []peer.ID) ([]PeerState, []bool) {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetStates(peers)
+}
+
+// RecordTransitionTimes is the concurrency safe version of QueryPeerset.RecordTransitionTimes.
+func (sqp *SyncQueryPeerset) RecordTransitionTimes() {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.RecordTransitionTimes()
+}
+
+// TimeInState is the concurrency safe version of QueryPeerset.TimeInState.
+func (sqp *SyncQueryPeerset) TimeInState(p peer.ID) time.Duration {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.TimeInState(p)
+}
+
+// PeersInStateOlderThan is the concurrency safe version of QueryPeerset.PeersInStateOlderThan.
+func (sqp *SyncQueryPeerset) PeersInStateOlderThan(state PeerState, d time.Duration) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.PeersInStateOlderThan(state, d)
+}
+
+// SetLatency is the concurrency safe version of QueryPeerset.SetLatency.
+func (sqp *SyncQueryPeerset) SetLatency(p peer.ID, d time.Duration) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.SetLatency(p, d)
+}
+
+// GetLatency is the concurrency safe version of QueryPeerset.GetLatency.
+func (sqp *SyncQueryPeerset) GetLatency(p peer.ID) time.Duration {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetLatency(p)
+}
+
+// SetResult is the concurrency safe version of QueryPeerset.SetResult.
+func (sqp *SyncQueryPeerset) SetResult(p peer.ID, result interface{}) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.SetResult(p, result)
+}
+
+// GetResult is the concurrency safe version of QueryPeerset.GetResult.
+func (sqp *SyncQueryPeerset) GetResult(p peer.ID) interface{} {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetResult(p)
+}
+
+// GetResultProviders is the concurrency safe version of QueryPeerset.GetResultProviders.
+func (sqp *SyncQueryPeerset) GetResultProviders() []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetResultProviders()
+}
+
+// RetryUnreachable is the concurrency safe version of QueryPeerset.RetryUnreachable.
+func (sqp *SyncQueryPeerset) RetryUnreachable(backoff time.Duration) int {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.RetryUnreachable(backoff)
+}
+
+// ResetUnreachable is the concurrency safe version of QueryPeerset.ResetUnreachable.
+func (sqp *SyncQueryPeerset) ResetUnreachable() int {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	return sqp.qp.ResetUnreachable()
+}
+
+// Exclude is the concurrency safe version of QueryPeerset.Exclude.
+func (sqp *SyncQueryPeerset) Exclude(p peer.ID) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.Exclude(p)
+}
+
+// IsExcluded is the concurrency safe version of QueryPeerset.IsExcluded.
+func (sqp *SyncQueryPeerset) IsExcluded(p peer.ID) bool {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.IsExcluded(p)
+}
+
+// GetExcludedInStates is the concurrency safe version of QueryPeerset.GetExcludedInStates.
+func (sqp *SyncQueryPeerset) GetExcludedInStates(states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetExcludedInStates(states...)
+}
+
+// SetMeta is the concurrency safe version of QueryPeerset.SetMeta.
+func (sqp *SyncQueryPeerset) SetMeta(p peer.ID, key string, val interface{}) {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	sqp.qp.SetMeta(p, key, val)
+}
+
+// GetMeta is the concurrency safe version of QueryPeerset.GetMeta.
+func (sqp *SyncQueryPeerset) GetMeta(p peer.ID, key string) (interface{}, bool) {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetMeta(p, key)
+}
+
+// GetReferrer is the concurrency safe version of QueryPeerset.GetReferrer.
+func (sqp *SyncQueryPeerset) GetReferrer(p peer.ID) peer.ID {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetReferrer(p)
+}
+
+// ReferralDepth is the concurrency safe version of QueryPeerset.ReferralDepth.
+func (sqp *SyncQueryPeerset) ReferralDepth(p peer.ID) int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.ReferralDepth(p)
+}
+
+// HasReferralCycle is the concurrency safe version of QueryPeerset.HasReferralCycle.
+func (sqp *SyncQueryPeerset) HasReferralCycle(p peer.ID) bool {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.HasReferralCycle(p)
+}
+
+// DistinctReferrerCount is the concurrency safe version of QueryPeerset.DistinctReferrerCount.
+func (sqp *SyncQueryPeerset) DistinctReferrerCount() int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.DistinctReferrerCount()
+}
+
+// DistinctGroupsInClosestN is the concurrency safe version of QueryPeerset.DistinctGroupsInClosestN.
+// The read lock is held while group is called, so group must not call methods of sqp that modify it.
+func (sqp *SyncQueryPeerset) DistinctGroupsInClosestN(n int, group func(peer.ID) string) int {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.DistinctGroupsInClosestN(n, group)
+}
+
+// ReferralTree is the concurrency safe version of QueryPeerset.ReferralTree.
+func (sqp *SyncQueryPeerset) ReferralTree() map[peer.ID][]peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.ReferralTree()
+}
+
+// GetReferredBy is the concurrency safe version of QueryPeerset.GetReferredBy.
+func (sqp *SyncQueryPeerset) GetReferredBy(referrer peer.ID) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetReferredBy(referrer)
+}
+
+// DistanceToKey is the concurrency safe version of QueryPeerset.DistanceToKey.
+func (sqp *SyncQueryPeerset) DistanceToKey(p peer.ID) *big.Int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.DistanceToKey(p)
+}
+
+// AllStates is the concurrency safe version of QueryPeerset.AllStates.
+func (sqp *SyncQueryPeerset) AllStates() []QueryPeerState {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.AllStates()
+}
+
+// Range is the concurrency safe version of QueryPeerset.Range.
+// The read lock is held for the whole iteration, so f must not call methods of sqp that modify it.
+func (sqp *SyncQueryPeerset) Range(f func(QueryPeerState) bool) {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	sqp.qp.Range(f)
+}
+
+// ClosestQueriedDistance is the concurrency safe version of QueryPeerset.ClosestQueriedDistance.
+func (sqp *SyncQueryPeerset) ClosestQueriedDistance() (*big.Int, bool) {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.ClosestQueriedDistance()
+}
+
+// GetClosestNInStates is the concurrency safe version of QueryPeerset.GetClosestNInStates.
+func (sqp *SyncQueryPeerset) GetClosestNInStates(n int, states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetClosestNInStates(n, states...)
+}
+
+// GetFarthestNInStates is the concurrency safe version of QueryPeerset.GetFarthestNInStates.
+func (sqp *SyncQueryPeerset) GetFarthestNInStates(n int, states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetFarthestNInStates(n, states...)
+}
+
+// GetFarthestInStates is the concurrency safe version of QueryPeerset.GetFarthestInStates.
+func (sqp *SyncQueryPeerset) GetFarthestInStates(states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetFarthestInStates(states...)
+}
+
+// GetClosestNInStatesByLatency is the concurrency safe version of QueryPeerset.GetClosestNInStatesByLatency.
+func (sqp *SyncQueryPeerset) GetClosestNInStatesByLatency(n int, states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetClosestNInStatesByLatency(n, states...)
+}
+
+// GetBestNInStates is the concurrency safe version of QueryPeerset.GetBestNInStates.
+// The read lock is held while score is called, so score must not call methods of sqp that modify it.
+func (sqp *SyncQueryPeerset) GetBestNInStates(n int, score func(QueryPeerState) float64, states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetBestNInStates(n, score, states...)
+}
+
+// GetClosestInStates is the concurrency safe version of QueryPeerset.GetClosestInStates.
+func (sqp *SyncQueryPeerset) GetClosestInStates(states ...PeerState) []peer.ID {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.GetClosestInStates(states...)
+}
+
+// HasPeerInState is the concurrency safe version of QueryPeerset.HasPeerInState.
+func (sqp *SyncQueryPeerset) HasPeerInState(states ...PeerState) bool {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.HasPeerInState(states...)
+}
+
+// NumHeard is the concurrency safe version of QueryPeerset.NumHeard.
+func (sqp *SyncQueryPeerset) NumHeard() int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.NumHeard()
+}
+
+// NumWaiting is the concurrency safe version of QueryPeerset.NumWaiting.
+func (sqp *SyncQueryPeerset) NumWaiting() int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.NumWaiting()
+}
+
+// NumQueried is the concurrency safe version of QueryPeerset.NumQueried.
+func (sqp *SyncQueryPeerset) NumQueried() int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.NumQueried()
+}
+
+// NumUnreachable is the concurrency safe version of QueryPeerset.NumUnreachable.
+func (sqp *SyncQueryPeerset) NumUnreachable() int {
+	sqp.lk.RLock()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.NumUnreachable()
+}
+
+// Health is the concurrency safe version of QueryPeerset.Health.
+// The snapshot is taken under a single lock, so it is consistent even while the peer set is modified concurrently.
+func (sqp *SyncQueryPeerset) Health() Health {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.Health()
+}
+
+// MarshalJSON is the concurrency safe version of QueryPeerset.MarshalJSON.
+func (sqp *SyncQueryPeerset) MarshalJSON() ([]byte, error) {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.MarshalJSON()
+}
+
+// UnmarshalJSON is the concurrency safe version of QueryPeerset.UnmarshalJSON.
+// It can also be used on a zero SyncQueryPeerset.
+func (sqp *SyncQueryPeerset) UnmarshalJSON(data []byte) error {
+	sqp.lk.Lock()
+	defer sqp.lk.Unlock()
+	if sqp.qp == nil {
+		sqp.qp = &QueryPeerset{}
+	}
+	return sqp.qp.UnmarshalJSON(data)
+}
+
+// String is the concurrency safe version of QueryPeerset.String.
+func (sqp *SyncQueryPeerset) String() string {
+	sqp.rlockSorted()
+	defer sqp.lk.RUnlock()
+	return sqp.qp.String()
+}
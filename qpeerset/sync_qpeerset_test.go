@@ -0,0 +1,47 @@
+package qpeerset
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncQPeerSetConcurrentAccess(t *testing.T) {
+	sqp := NewSyncQueryPeerset("test")
+	oracle := test.RandPeerIDFatal(t)
+
+	const workers = 8
+	const perWorker = 25
+
+	peers := make([][]peer.ID, workers)
+	for w := range peers {
+		for i := 0; i < perWorker; i++ {
+			peers[w] = append(peers[w], test.RandPeerIDFatal(t))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(peers []peer.ID) {
+			defer wg.Done()
+			for _, p := range peers {
+				sqp.TryAdd(p, oracle)
+				sqp.SetState(p, PeerWaiting)
+				_ = sqp.GetClosestNInStates(3, PeerHeard, PeerWaiting)
+				sqp.SetState(p, PeerQueried)
+				_ = sqp.GetReferrer(p)
+			}
+		}(peers[w])
+	}
+	wg.Wait()
+
+	require.Len(t, sqp.GetClosestInStates(PeerQueried), workers*perWorker)
+	require.Equal(t, 0, sqp.NumHeard())
+	require.Equal(t, 0, sqp.NumWaiting())
+	require.Equal(t, []peer.ID(nil), sqp.GetClosestInStates(PeerUnreachable))
+}
@@ -274,6 +274,7 @@ func (q *query) run() {
 		select {
 		case update := <-ch:
 			q.updateState(pathCtx, update)
+			publishLookupProgress(q.ctx, q.id, q.key, q.queryPeers)
 			cause = update.cause
 		case <-pathCtx.Done():
 			q.terminate(pathCtx, cancelPath, LookupCancelled)
@@ -478,6 +479,7 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 		}
 		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
 			q.queryPeers.SetState(p, qpeerset.PeerQueried)
+			q.queryPeers.SetLatency(p, up.queryDuration)
 			q.peerTimes[p] = up.queryDuration
 		} else {
 			panic(fmt.Errorf("kademlia protocol error: tried to transition to the queried state from state %v", st))
@@ -3,6 +3,7 @@ package dht
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -116,3 +117,46 @@ func checkRoutingTable(a, b *IpfsDHT) bool {
 	// under high load, this may not happen as immediately as we would like.
 	return a.routingTable.Find(b.self) != "" && b.routingTable.Find(a.self) != ""
 }
+
+func TestLookupProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[2], dhts[3])
+
+	var (
+		mu       sync.Mutex
+		progress []*LookupProgress
+	)
+	pctx := RegisterForLookupProgress(ctx, func(p *LookupProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress = append(progress, p)
+	})
+
+	_, err := dhts[0].GetClosestPeers(pctx, "test")
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, progress)
+
+	last := progress[len(progress)-1]
+	require.Equal(t, "test", last.Key)
+	require.Equal(t, progress[0].ID, last.ID)
+	require.NotZero(t, last.NumQueried)
+	require.NotNil(t, last.ClosestQueriedDistance)
+	require.Len(t, last.Peers, last.NumHeard+last.NumWaiting+last.NumQueried+last.NumUnreachable)
+	for i := 1; i < len(last.Peers); i++ {
+		require.True(t, last.Peers[i-1].Distance.Cmp(last.Peers[i].Distance) <= 0)
+	}
+}